@@ -0,0 +1,336 @@
+package bencode
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var (
+	benchTorrentOnce sync.Once
+	benchTorrent     []byte
+)
+
+// benchTorrentData returns a multi-file torrent shaped like a typical
+// release: a few trackers, a hundred files in nested directories and a
+// thousand piece hashes.
+func benchTorrentData(b *testing.B) []byte {
+	benchTorrentOnce.Do(func() {
+		t := Torrent{
+			Announce: "http://tracker.example.org:6969/announce",
+			AnnounceList: [][]string{
+				{"http://tracker.example.org:6969/announce"},
+				{"udp://tracker.example.org:6969", "udp://backup.example.org:1337"},
+			},
+			Comment:      "benchmark fixture",
+			CreatedBy:    "go-bencode",
+			CreationDate: 1600000000,
+			Info: Info{
+				Name:        "release",
+				PieceLength: 1 << 18,
+				Pieces:      bytes.Repeat([]byte("0123456789abcdefghij"), 1000),
+			},
+		}
+		for i := 0; i < 100; i++ {
+			t.Info.Files = append(t.Info.Files, File{
+				Length: int64(1<<20 + i),
+				Path:   []string{fmt.Sprintf("disc%d", i/10), fmt.Sprintf("track%02d.flac", i)},
+			})
+		}
+
+		var err error
+		benchTorrent, err = Marshal(&t)
+		if err != nil {
+			panic(err)
+		}
+	})
+	b.SetBytes(int64(len(benchTorrent)))
+	return benchTorrent
+}
+
+func BenchmarkUnmarshalTorrentStruct(b *testing.B) {
+	data := benchTorrentData(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var t Torrent
+		if err := Unmarshal(data, &t); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUnmarshalTorrentInterface(b *testing.B) {
+	data := benchTorrentData(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var v map[string]interface{}
+		if err := Unmarshal(data, &v); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecoderTorrentStream(b *testing.B) {
+	data := benchTorrentData(b)
+	const values = 16
+	stream := bytes.Repeat(data, values)
+	b.SetBytes(int64(len(stream)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		dec := NewDecoder(bytes.NewReader(stream))
+		for {
+			var t Torrent
+			err := dec.Decode(&t)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// benchmarkDecoderSmallTorrent decodes a torrent of a few hundred bytes, for
+// which setting up the Decoder's buffer is a large part of the work.
+func benchmarkDecoderSmallTorrent(b *testing.B, readAll bool) {
+	b.SetBytes(int64(len(multiFile)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		dec := NewDecoder(strings.NewReader(multiFile))
+		if readAll {
+			dec.ReadAll()
+		}
+		var t Torrent
+		if err := dec.Decode(&t); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecoderSmallTorrent(b *testing.B) {
+	benchmarkDecoderSmallTorrent(b, false)
+}
+
+func BenchmarkDecoderSmallTorrentReadAll(b *testing.B) {
+	benchmarkDecoderSmallTorrent(b, true)
+}
+
+func benchmarkDecoderInterfaceStream(b *testing.B, intern bool) {
+	data := benchTorrentData(b)
+	const values = 16
+	stream := bytes.Repeat(data, values)
+	b.SetBytes(int64(len(stream)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		dec := NewDecoder(bytes.NewReader(stream))
+		if intern {
+			dec.InternKeys()
+		}
+		for {
+			var v map[string]interface{}
+			err := dec.Decode(&v)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkDecoderInterfaceStream(b *testing.B) {
+	benchmarkDecoderInterfaceStream(b, false)
+}
+
+func BenchmarkDecoderInterfaceStreamInterned(b *testing.B) {
+	benchmarkDecoderInterfaceStream(b, true)
+}
+
+func benchmarkDecoderReuseSlice(b *testing.B, reuse bool) {
+	var buf bytes.Buffer
+	for i := 0; i < 64; i++ {
+		buf.WriteString("d2:ip9:127.0.0.14:porti6881ee")
+	}
+	data := []byte("l" + buf.String() + "e")
+	type peer struct {
+		IP   string `bencode:"ip"`
+		Port int    `bencode:"port"`
+	}
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	var peers []peer
+	for i := 0; i < b.N; i++ {
+		if !reuse {
+			peers = nil
+		}
+		if err := NewDecoder(bytes.NewReader(data)).Decode(&peers); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecoderFreshSlice(b *testing.B) {
+	benchmarkDecoderReuseSlice(b, false)
+}
+
+func BenchmarkDecoderReuseSlice(b *testing.B) {
+	benchmarkDecoderReuseSlice(b, true)
+}
+
+func BenchmarkUnmarshalTorrentBatch(b *testing.B) {
+	data := benchTorrentData(b)
+	const values = 16
+	b.SetBytes(int64(len(data) * values))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < values; j++ {
+			var t Torrent
+			if err := Unmarshal(data, &t); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkMarshalTorrent(b *testing.B) {
+	var t Torrent
+	if err := Unmarshal(benchTorrentData(b), &t); err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Marshal(&t); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// benchResponse is a small value like a tracker response, for benchmarks
+// of encoding many values one after the other.
+var benchResponse = struct {
+	Interval int    `bencode:"interval"`
+	Peers    []byte `bencode:"peers"`
+}{1800, bytes.Repeat([]byte{10, 0, 0, 1, 0x1a, 0xe1}, 8)}
+
+func BenchmarkMarshalSmall(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := Marshal(&benchResponse); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMarshalAppendSmall(b *testing.B) {
+	var buf []byte
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var err error
+		if buf, err = MarshalAppend(buf[:0], &benchResponse); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkValidTorrent(b *testing.B) {
+	data := benchTorrentData(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !Valid(data) {
+			b.Fatal("invalid fixture")
+		}
+	}
+}
+
+func BenchmarkPieceHashes(b *testing.B) {
+	var t Torrent
+	if err := Unmarshal(benchTorrentData(b), &t); err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(len(t.Info.Pieces)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := PieceHashes(t.Info.Pieces); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPieceHashesGeneric(b *testing.B) {
+	var t Torrent
+	if err := Unmarshal(benchTorrentData(b), &t); err != nil {
+		b.Fatal(err)
+	}
+	// The generic decoder can only split the hashes when they are encoded
+	// as a list of strings, so re-encode them that way first.
+	list := make([][]byte, 0, len(t.Info.Pieces)/20)
+	for i := 0; i < len(t.Info.Pieces); i += 20 {
+		list = append(list, t.Info.Pieces[i:i+20])
+	}
+	data, err := Marshal(list)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(len(t.Info.Pieces)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var hashes [][20]byte
+		if err := Unmarshal(data, &hashes); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// benchInt64 is an int64 that list decodes through the generic path.
+type benchInt64 int64
+
+func benchIntList(b *testing.B) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte('l')
+	for i := 0; i < 100000; i++ {
+		fmt.Fprintf(&buf, "i%de", 1<<20+i)
+	}
+	buf.WriteByte('e')
+	return buf.Bytes()
+}
+
+func BenchmarkUnmarshalIntList(b *testing.B) {
+	data := benchIntList(b)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var list []int64
+		if err := Unmarshal(data, &list); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUnmarshalIntListGeneric(b *testing.B) {
+	data := benchIntList(b)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var list []benchInt64
+		if err := Unmarshal(data, &list); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
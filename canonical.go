@@ -0,0 +1,185 @@
+package bencode
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// IsCanonical reports whether data is a single bencode value in canonical
+// form, the form Marshal produces and the one a torrent's info-hash is
+// computed over.
+func IsCanonical(data []byte) bool {
+	return CheckCanonical(data) == nil
+}
+
+// CheckCanonical is like IsCanonical but returns an error describing why
+// data is not canonical. Besides being valid bencode, which already rules out
+// integers and string lengths with leading zeroes and negative zero, canonical
+// data has the keys of every dictionary in strictly increasing byte order, so
+// without duplicates, and nothing after its top-level value. Invalid bencode
+// is reported by a SyntaxError, trailing data by one wrapping
+// ErrTrailingData, and valid bencode with unsorted or duplicate keys by a
+// CanonicalError.
+func CheckCanonical(data []byte) error {
+	var scan scanner
+	if err := checkValid(data, &scan); err != nil {
+		return err
+	}
+	_, err := checkCanonical(data, 0)
+	return err
+}
+
+// A CanonicalError describes bencode that is well-formed but not in
+// canonical form, as opposed to a SyntaxError, which describes input that is
+// not bencode at all.
+type CanonicalError struct {
+	Offset int64  // offset of the dictionary key at fault
+	Reason string // description of the problem
+}
+
+func (e *CanonicalError) Error() string {
+	return "bencode: " + e.Reason + " at offset " + strconv.FormatInt(e.Offset, 10)
+}
+
+func duplicateKeyError(key []byte, off int) error {
+	return &CanonicalError{Offset: int64(off), Reason: fmt.Sprintf("duplicate dictionary key %q", key)}
+}
+
+// checkCanonical checks the valid value starting at data[off] and returns
+// the offset just past it.
+func checkCanonical(data []byte, off int) (int, error) {
+	switch data[off] {
+	case 'i':
+		return off + bytes.IndexByte(data[off:], 'e') + 1, nil
+	case 'l':
+		off++
+		for data[off] != 'e' {
+			var err error
+			if off, err = checkCanonical(data, off); err != nil {
+				return 0, err
+			}
+		}
+		return off + 1, nil
+	case 'd':
+		off++
+		var prev []byte
+		for i := 0; data[off] != 'e'; i++ {
+			keyOff := off
+			key, next := canonicalString(data, off)
+			if i > 0 {
+				switch c := bytes.Compare(prev, key); {
+				case c == 0:
+					return 0, duplicateKeyError(key, keyOff)
+				case c > 0:
+					return 0, &CanonicalError{Offset: int64(keyOff), Reason: fmt.Sprintf("dictionary key %q is not sorted after %q", key, prev)}
+				}
+			}
+			prev = key
+
+			var err error
+			if off, err = checkCanonical(data, next); err != nil {
+				return 0, err
+			}
+		}
+		return off + 1, nil
+	}
+	_, off = canonicalString(data, off)
+	return off, nil
+}
+
+// canonicalString returns the contents of the valid string starting at
+// data[off] and the offset just past it.
+func canonicalString(data []byte, off int) ([]byte, int) {
+	colon := off + bytes.IndexByte(data[off:], ':')
+	n, _ := strconv.Atoi(string(data[off:colon]))
+	return data[colon+1 : colon+1+n], colon + 1 + n
+}
+
+// SortKeys returns a copy of the single bencode value in data with the keys
+// of every dictionary in increasing byte order, leaving everything else as
+// it is. It works on the encoded bytes, moving each key together with its
+// value, so it is cheaper than decoding data into an interface value and
+// marshaling it again. Its result is canonical, unless data holds a
+// dictionary with a duplicate key, which is a CanonicalError.
+func SortKeys(data []byte) ([]byte, error) {
+	var scan scanner
+	if err := checkValid(data, &scan); err != nil {
+		return nil, err
+	}
+	dst, _, err := sortKeys(make([]byte, 0, len(data)), data, 0)
+	if err != nil {
+		return nil, err
+	}
+	return dst, nil
+}
+
+// sortedEntry is the span of a dictionary key and its value.
+type sortedEntry struct {
+	key      []byte
+	keyOff   int
+	valueOff int
+}
+
+// sortKeys appends the valid value starting at data[off] to dst with its
+// dictionaries sorted, and returns the offset just past it.
+func sortKeys(dst, data []byte, off int) ([]byte, int, error) {
+	var err error
+	switch data[off] {
+	case 'i':
+		end := off + bytes.IndexByte(data[off:], 'e') + 1
+		return append(dst, data[off:end]...), end, nil
+	case 'l':
+		dst = append(dst, 'l')
+		off++
+		for data[off] != 'e' {
+			if dst, off, err = sortKeys(dst, data, off); err != nil {
+				return nil, 0, err
+			}
+		}
+		return append(dst, 'e'), off + 1, nil
+	case 'd':
+		off++
+		var entries []sortedEntry
+		for data[off] != 'e' {
+			key, next := canonicalString(data, off)
+			entries = append(entries, sortedEntry{key: key, keyOff: off, valueOff: next})
+			off = skipValue(data, next)
+		}
+		sort.SliceStable(entries, func(i, j int) bool {
+			return bytes.Compare(entries[i].key, entries[j].key) < 0
+		})
+
+		dst = append(dst, 'd')
+		for i, e := range entries {
+			if i > 0 && bytes.Equal(entries[i-1].key, e.key) {
+				return nil, 0, duplicateKeyError(e.key, e.keyOff)
+			}
+			dst = append(dst, data[e.keyOff:e.valueOff]...)
+			if dst, _, err = sortKeys(dst, data, e.valueOff); err != nil {
+				return nil, 0, err
+			}
+		}
+		return append(dst, 'e'), off + 1, nil
+	}
+	_, end := canonicalString(data, off)
+	return append(dst, data[off:end]...), end, nil
+}
+
+// skipValue returns the offset just past the valid value starting at
+// data[off].
+func skipValue(data []byte, off int) int {
+	switch data[off] {
+	case 'i':
+		return off + bytes.IndexByte(data[off:], 'e') + 1
+	case 'l', 'd':
+		off++
+		for data[off] != 'e' {
+			off = skipValue(data, off)
+		}
+		return off + 1
+	}
+	_, off = canonicalString(data, off)
+	return off
+}
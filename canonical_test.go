@@ -0,0 +1,172 @@
+package bencode
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestIsCanonical(t *testing.T) {
+	for _, tt := range []struct {
+		data string
+		ok   bool
+	}{
+		{`i0e`, true},
+		{`0:`, true},
+		{`de`, true},
+		{`d1:ai1e1:bi2ee`, true},
+		{`d1:ad1:xle1:yleee`, true},
+		{`l3:foo3:bare`, true},
+		{`d2:aa0:1:b0:e`, true},
+		{`d1:bi2e1:ai1ee`, false},
+		{`d1:ai1e1:ai2ee`, false},
+		{`l1:xd1:y0:1:x0:ee`, false},
+		{`i01e`, false},
+		{`i-0e`, false},
+		{`01:a`, false},
+		{`i1ei2e`, false},
+		{`d1:ai1e`, false},
+		{``, false},
+	} {
+		if ok := IsCanonical([]byte(tt.data)); ok != tt.ok {
+			t.Errorf("IsCanonical(%#q) = %v, want %v", tt.data, ok, tt.ok)
+		}
+	}
+}
+
+func TestCanonicalMarshal(t *testing.T) {
+	// Inputs with unsorted keys come out sorted, as SortKeys sorts them.
+	for _, data := range []string{
+		`d1:bi2e1:ai1ee`,
+		`d1:bd1:y0:1:x0:e1:al1:bd1:d0:1:c0:eee`,
+		`d2:aa0:1:b0:1:a0:e`,
+	} {
+		var v interface{}
+		if err := Unmarshal([]byte(data), &v); err != nil {
+			t.Errorf("Unmarshal(%#q): %v", data, err)
+			continue
+		}
+		b, err := Marshal(v)
+		if err != nil {
+			t.Errorf("Marshal(%#q): %v", data, err)
+			continue
+		}
+		if err := CheckCanonical(b); err != nil {
+			t.Errorf("CheckCanonical(%#q): %v", b, err)
+		}
+		if want, err := SortKeys([]byte(data)); err != nil || string(b) != string(want) {
+			t.Errorf("Marshal of %#q = %#q, want %#q", data, b, want)
+		}
+	}
+
+	// Struct fields are sorted by key, not by declaration order.
+	b, err := Marshal(struct {
+		Z  int    `bencode:"z"`
+		A  string `bencode:"a"`
+		AA []byte `bencode:"aa"`
+	}{1, "x", []byte("y")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckCanonical(b); err != nil {
+		t.Errorf("CheckCanonical(%#q): %v", b, err)
+	}
+}
+
+func TestCanonicalMarshalRaw(t *testing.T) {
+	// Marshal writes raw dictionaries as they are; CanonicalMarshal sorts
+	// them.
+	v := RawDictionary{{"b", RawMessage(`i1e`)}, {"a", RawMessage(`d1:yi0e1:xi0ee`)}}
+	b, err := CanonicalMarshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `d1:ad1:xi0e1:yi0ee1:bi1ee`; string(b) != want {
+		t.Errorf("CanonicalMarshal = %#q, want %#q", b, want)
+	}
+	if !IsCanonical(b) {
+		t.Errorf("CanonicalMarshal = %#q, which is not canonical", b)
+	}
+
+	dup := RawDictionary{{"a", RawMessage(`i1e`)}, {"a", RawMessage(`i2e`)}}
+	if _, err := CanonicalMarshal(dup); err == nil {
+		t.Error("CanonicalMarshal of a duplicate key succeeded")
+	} else if _, ok := err.(*CanonicalError); !ok {
+		t.Errorf("CanonicalMarshal of a duplicate key = %v, want *CanonicalError", err)
+	}
+}
+
+func TestSortKeys(t *testing.T) {
+	for _, tt := range []struct {
+		data string
+		want string
+	}{
+		{`i1e`, `i1e`},
+		{`d1:bi2e1:ai1ee`, `d1:ai1e1:bi2ee`},
+		{`d1:bd1:y0:1:x0:e1:al1:bd1:d0:1:c0:eee`, `d1:al1:bd1:c0:1:d0:ee1:bd1:x0:1:y0:ee`},
+		{`d2:aa0:1:b0:1:a0:e`, `d1:a0:2:aa0:1:b0:e`},
+	} {
+		got, err := SortKeys([]byte(tt.data))
+		if err != nil {
+			t.Errorf("SortKeys(%#q): %v", tt.data, err)
+			continue
+		}
+		if string(got) != tt.want {
+			t.Errorf("SortKeys(%#q) = %#q, want %#q", tt.data, got, tt.want)
+		}
+		if !IsCanonical(got) {
+			t.Errorf("SortKeys(%#q) = %#q, which is not canonical", tt.data, got)
+		}
+	}
+
+	for _, bad := range []string{`d1:ai1e1:ai2ee`, `d1:ai1e`, `i1ei2e`} {
+		if got, err := SortKeys([]byte(bad)); err == nil {
+			t.Errorf("SortKeys(%#q) = %#q, want an error", bad, got)
+		}
+	}
+}
+
+func TestCanonicalError(t *testing.T) {
+	for _, tt := range []struct {
+		data   string
+		offset int64
+		reason string
+	}{
+		{`d1:bi2e1:ai1ee`, 7, `dictionary key "a" is not sorted after "b"`},
+		{`d1:ai1e1:ai2ee`, 7, `duplicate dictionary key "a"`},
+		{`l1:xd1:y0:1:x0:ee`, 10, `dictionary key "x" is not sorted after "y"`},
+		{`d1:ad1:ai1e1:ai2eee`, 11, `duplicate dictionary key "a"`},
+		{`d2:aa0:1:a0:e`, 7, `dictionary key "a" is not sorted after "aa"`},
+	} {
+		err := CheckCanonical([]byte(tt.data))
+		ce, ok := err.(*CanonicalError)
+		if !ok {
+			t.Errorf("CheckCanonical(%#q) = %v, want *CanonicalError", tt.data, err)
+			continue
+		}
+		if ce.Offset != tt.offset || ce.Reason != tt.reason {
+			t.Errorf("CheckCanonical(%#q) = %+v, want offset %d and reason %q", tt.data, *ce, tt.offset, tt.reason)
+		}
+	}
+
+	// Duplicates are the only keys SortKeys cannot fix.
+	_, err := SortKeys([]byte(`d1:bi1e1:ai1e1:bi2ee`))
+	if ce, ok := err.(*CanonicalError); !ok || ce.Offset != 13 || ce.Reason != `duplicate dictionary key "b"` {
+		t.Errorf("SortKeys with a duplicate key = %v, want *CanonicalError at offset 13", err)
+	}
+
+	// Malformed input is a SyntaxError, not a CanonicalError.
+	for _, bad := range []string{`i01e`, `i-0e`, `01:a`, `d1:ai1e`, `i1ei2e`, `di1ei2ee`} {
+		if _, ok := CheckCanonical([]byte(bad)).(*SyntaxError); !ok {
+			t.Errorf("CheckCanonical(%#q) = %v, want *SyntaxError", bad, CheckCanonical([]byte(bad)))
+		}
+	}
+	// Trailing data is reported like Unmarshal reports it.
+	for _, bad := range []string{`i1ei2e`, `dex`, `0:0:`} {
+		if err := CheckCanonical([]byte(bad)); !errors.Is(err, ErrTrailingData) {
+			t.Errorf("CheckCanonical(%#q) = %v, want ErrTrailingData", bad, err)
+		}
+		if _, err := SortKeys([]byte(bad)); !errors.Is(err, ErrTrailingData) {
+			t.Errorf("SortKeys(%#q) = %v, want ErrTrailingData", bad, err)
+		}
+	}
+}
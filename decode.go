@@ -2,13 +2,53 @@ package bencode
 
 import (
 	"bytes"
-	"encoding/base64"
+	"context"
+	"encoding"
+	"errors"
 	"fmt"
 	"io"
 	"reflect"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
+// Unmarshal parses the bencode-encoded data and stores the result in the
+// value pointed to by v. If v is nil or not a pointer, Unmarshal returns an
+// InvalidUnmarshalError. Only v itself must be non-nil: any pointers it
+// points to, such as the *T of a **T, are allocated as needed.
+//
+// data must hold exactly one value. If anything follows it, Unmarshal
+// returns a SyntaxError wrapping ErrTrailingData, whose Offset is that of the
+// first trailing byte. Use a Decoder to read a stream of values.
+//
+// Bencode strings are binary: a string decodes byte for byte into a Go
+// string, a []byte, or a [N]byte of exactly its length, such as the [20]byte
+// of a SHA-1 hash, without any decoding of its contents. A string decodes
+// into a slice of byte arrays, such as the [][20]byte of a torrent's piece
+// hashes, by splitting it into consecutive arrays; its length must then be a
+// multiple of the array length. As in encoding/json, the empty string 0:
+// decodes into a []byte as an empty, non-nil slice, and into a *string as a
+// non-nil pointer to "".
+//
+// A list decodes into a slice by overwriting it: the slice is resliced to
+// hold exactly the decoded elements, reusing its backing array when its
+// capacity is large enough, and elements of the backing array beyond the new
+// length are cleared. Decoding lists of the same shape into one slice in a
+// loop thus allocates no new backing array. Elements within the old length
+// are decoded into like any existing value.
+//
+// Bencode has no booleans. A bool decodes from the integer 0 or 1, as
+// Marshal encodes it, and any other integer is an UnmarshalTypeError rather
+// than true, so that a malformed flag such as a torrent's private key is not
+// silently accepted.
+//
+// To unmarshal into an interface value, Unmarshal stores a
+// map[string]interface{} for dictionaries, []interface{} for lists, int64
+// for integers (or Number if the Decoder's UseNumber was called) and string
+// for strings. An integer out of the range of int64, which bencode allows, is
+// stored as a Number, so any valid input decodes into an interface value.
 func Unmarshal(data []byte, v interface{}) error {
 	var d decodeState
 	err := checkValid(data, &d.scan)
@@ -20,6 +60,104 @@ func Unmarshal(data []byte, v interface{}) error {
 	return d.unmarshal(v)
 }
 
+// UnmarshalValue is like Unmarshal but stores the result in rv itself, for
+// callers that already hold a reflect.Value, such as one created with
+// reflect.New(t).Elem(), instead of a pointer. rv must be settable.
+func UnmarshalValue(data []byte, rv reflect.Value) error {
+	if !rv.IsValid() {
+		return &InvalidUnmarshalError{nil}
+	}
+	if !rv.CanSet() {
+		return errors.New("bencode: UnmarshalValue of unsettable " + rv.Type().String())
+	}
+
+	var d decodeState
+	err := checkValid(data, &d.scan)
+	if err != nil {
+		return err
+	}
+
+	d.init(data)
+	return d.unmarshalValue(rv)
+}
+
+// UnmarshalWithSpans is like Unmarshal but also reports where in data the
+// value of each struct field was found. The returned map holds the
+// [start, end) byte offsets of the value for the name of every field set from
+// the input, using the same dotted paths as UnmarshalWithPresence, so that
+// data[span[0]:span[1]] is the field's bencode encoding. A field's key is
+// not part of its span. As the elements of a list share a path, a field of a
+// struct in a list has the span of its value in the last element.
+func UnmarshalWithSpans(data []byte, v interface{}) (map[string][2]int, error) {
+	var d decodeState
+	err := checkValid(data, &d.scan)
+	if err != nil {
+		return nil, err
+	}
+
+	d.init(data)
+	d.spans = make(map[string][2]int)
+	err = d.unmarshal(v)
+	return d.spans, err
+}
+
+// UnmarshalContext is like Unmarshal but gives up, returning ctx.Err(), once
+// ctx is done. The context is checked periodically while the input is
+// validated and decoded, so a deadline bounds the time spent on a huge or
+// pathological input.
+func UnmarshalContext(ctx context.Context, data []byte, v interface{}) error {
+	var d decodeState
+	err := checkValidContext(ctx, data, &d.scan)
+	if err != nil {
+		return err
+	}
+
+	d.init(data)
+	d.ctx = ctx
+	return d.unmarshal(v)
+}
+
+// UnmarshalWithPresence is like Unmarshal but also reports which struct
+// fields were set from the input, which distinguishes a field explicitly set
+// to its zero value from one that was absent. The returned map has an entry
+// for the name of every such field. Fields of nested structs are named by
+// their path from v, joining field names and map keys with dots, as in
+// "info.name"; the elements of a list share the path of the list.
+func UnmarshalWithPresence(data []byte, v interface{}) (present map[string]bool, err error) {
+	var d decodeState
+	err = checkValid(data, &d.scan)
+	if err != nil {
+		return nil, err
+	}
+
+	d.init(data)
+	d.present = make(map[string]bool)
+	err = d.unmarshal(v)
+	return d.present, err
+}
+
+// UnmarshalMaxInterfaceNodes is like Unmarshal but limits the number of
+// nodes created while decoding into an empty interface to n, as
+// Decoder.SetMaxInterfaceNodes does. Once the limit is exceeded it returns an
+// error wrapping ErrTooManyInterfaceNodes.
+func UnmarshalMaxInterfaceNodes(data []byte, v interface{}, n int) error {
+	var d decodeState
+	err := checkValid(data, &d.scan)
+	if err != nil {
+		return err
+	}
+
+	d.init(data)
+	d.maxInterfaceNodes = n
+	return d.unmarshal(v)
+}
+
+// ErrTooManyInterfaceNodes is wrapped by the error returned when a value
+// decoded into an empty interface exceeds the limit set with
+// Decoder.SetMaxInterfaceNodes or UnmarshalMaxInterfaceNodes. Check for it
+// with errors.Is.
+var ErrTooManyInterfaceNodes = errors.New("bencode: value exceeds maximum number of interface nodes")
+
 type Unmarshaler interface {
 	UnmarshalBencode([]byte) error
 }
@@ -39,6 +177,25 @@ func (e *UnmarshalTypeError) Error() string {
 	return "bencode: cannot unmarshal " + e.Value + " into Go value of type " + e.Type.String()
 }
 
+// An OverflowError describes a bencode integer that is out of range for the
+// Go value it was decoded into, such as a negative integer for an unsigned
+// type. Unlike an UnmarshalTypeError, it means that the integer itself is
+// well-formed and could be decoded into a wider type such as a big.Int.
+type OverflowError struct {
+	Value  string       // the integer, in decimal
+	Type   reflect.Type // type of Go value it could not be assigned to
+	Offset int64        // error occurred after reading Offset bytes
+	Struct string       // name of the struct type containing the field
+	Field  string       // name of the field holding the Go value
+}
+
+func (e *OverflowError) Error() string {
+	if e.Struct != "" || e.Field != "" {
+		return "bencode: integer " + e.Value + " overflows Go struct field " + e.Struct + "." + e.Field + " of type " + e.Type.String()
+	}
+	return "bencode: integer " + e.Value + " overflows Go value of type " + e.Type.String()
+}
+
 type InvalidUnmarshalError struct {
 	Type reflect.Type
 }
@@ -66,6 +223,71 @@ type decodeState struct {
 	savedError            error
 	useNumber             bool
 	disallowUnknownFields bool
+	requireFieldMatch     bool
+	failFast              bool
+	maxListElements       int
+	preserveSlices        bool
+	stringsAsNumbers      bool
+	intMapStrings         bool
+
+	// maxInterfaceNodes limits the number of maps, slices, strings and
+	// integers created for interface values, counted by interfaceNodes.
+	maxInterfaceNodes int
+	interfaceNodes    int
+
+	// numString is set while decoding the value of a struct field with the
+	// "numstring" tag option, which accepts strings as numbers like
+	// stringsAsNumbers does for every field.
+	numString bool
+
+	// intString is set while decoding a map value of string kind after
+	// IntegerMapValuesAsStrings, which accepts integers as their decimal
+	// string.
+	intString bool
+
+	// present, if not nil, records the path of every struct field that a
+	// dictionary key was decoded into. path is the prefix for fields of the
+	// dictionary being decoded: the dot-terminated path of the struct field
+	// or map key holding it.
+	present map[string]bool
+	path    string
+
+	// spans, if not nil, records the offsets of the value of every struct
+	// field a dictionary key was decoded into, by the same paths as present.
+	spans map[string][2]int
+
+	// ctx, if not nil, is checked every contextCheckInterval values, counted
+	// by ctxValues.
+	ctx       context.Context
+	ctxValues int
+
+	// onlyKeys, if not nil, holds the only keys of the top-level dictionary
+	// to decode; DecodeKeys skips the values of all others.
+	onlyKeys   map[string]bool
+	nameMapper func([]byte) string
+
+	// internedKeys, if not nil, maps the map keys decoded so far to a
+	// single string for each, so that repeated keys share their memory.
+	internedKeys map[string]reflect.Value
+}
+
+// maxInternedKeys is the most keys internedKeys holds. Keys seen after it is
+// full are decoded as if interning was off.
+const maxInternedKeys = 4096
+
+// mapKey returns the map key with the bytes key, interned if enabled.
+func (d *decodeState) mapKey(key []byte) reflect.Value {
+	if d.internedKeys == nil {
+		return reflect.ValueOf(string(key))
+	}
+	if kv, ok := d.internedKeys[string(key)]; ok {
+		return kv
+	}
+	kv := reflect.ValueOf(string(key))
+	if len(d.internedKeys) < maxInternedKeys {
+		d.internedKeys[kv.String()] = kv
+	}
+	return kv
 }
 
 func (d *decodeState) readIndex() int {
@@ -74,16 +296,47 @@ func (d *decodeState) readIndex() int {
 
 const phasePanicMsg = "Bencode decoder out of sync - data changing underfoot?"
 
+// syntaxError reports that the decoder found an opcode it cannot continue
+// from, which the scanner should have made impossible. It is returned
+// instead of panicking so that an inconsistency cannot stall or crash a
+// caller.
+func (d *decodeState) syntaxError(context string) error {
+	return &SyntaxError{msg: "unexpected token " + context, Offset: int64(d.readIndex()), Context: context}
+}
+
 func (d *decodeState) init(data []byte) *decodeState {
 	d.data = data
 	d.off = 0
 	d.savedError = nil
 	d.errorContext.Struct = nil
 	d.errorContext.Field = ""
+	d.interfaceNodes = 0
+	d.numString = false
+	d.intString = false
+	d.path = ""
 	return d
 }
 
+// decodeAbort is the panic value with which saveError stops decoding after
+// FailFast.
+type decodeAbort struct{ err error }
+
+// recoverAbort stops a panic with a decodeAbort and stores its error in
+// *err. It must be deferred by every function that starts decoding a value.
+func recoverAbort(err *error) {
+	if r := recover(); r != nil {
+		a, ok := r.(decodeAbort)
+		if !ok {
+			panic(r)
+		}
+		*err = a.err
+	}
+}
+
 func (d *decodeState) saveError(err error) {
+	if d.failFast {
+		panic(decodeAbort{d.addErrorContext(err)})
+	}
 	if d.savedError == nil {
 		d.savedError = d.addErrorContext(err)
 	}
@@ -96,6 +349,10 @@ func (d *decodeState) addErrorContext(err error) error {
 			err.Struct = d.errorContext.Struct.Name()
 			err.Field = d.errorContext.Field
 			return err
+		case *OverflowError:
+			err.Struct = d.errorContext.Struct.Name()
+			err.Field = d.errorContext.Field
+			return err
 		}
 	}
 	return err
@@ -104,7 +361,7 @@ func (d *decodeState) addErrorContext(err error) error {
 func (d *decodeState) skip() {
 	s, data, i := &d.scan, d.data, d.off
 	depth := len(s.parseState)
-	for {
+	for i < len(data) {
 		op := s.step(s, data[i])
 		i++
 		if len(s.parseState) < depth {
@@ -113,6 +370,9 @@ func (d *decodeState) skip() {
 			return
 		}
 	}
+
+	d.off = len(data) + 1
+	d.opcode = d.scan.eof()
 }
 
 func (d *decodeState) scanNext() {
@@ -126,6 +386,18 @@ func (d *decodeState) scanNext() {
 	}
 }
 
+// stringStart returns the offset of the first byte of the string whose
+// scanString opcode has just been read. The scanner reports scanString on the
+// first byte of a non-empty string, but on the length delimiter of an empty
+// one.
+func (d *decodeState) stringStart() int {
+	i := d.readIndex()
+	if d.data[i-1] != ':' {
+		i++
+	}
+	return i
+}
+
 func (d *decodeState) scanWhile(op int) {
 	s, data, i := &d.scan, d.data, d.off
 	for i < len(data) {
@@ -147,20 +419,54 @@ func (d *decodeState) unmarshal(v interface{}) error {
 	if rv.Kind() != reflect.Ptr || rv.IsNil() {
 		return &InvalidUnmarshalError{reflect.TypeOf(v)}
 	}
+	return d.unmarshalValue(rv)
+}
+
+// unmarshalValue decodes the value in d.data into rv, which unlike the
+// argument of unmarshal need not be a pointer.
+func (d *decodeState) unmarshalValue(rv reflect.Value) (err error) {
+	defer recoverAbort(&err)
 
 	d.scan.reset()
 	d.scanNext()
 	if d.scan.bytes == 0 {
 		return io.EOF
 	}
-	err := d.value(rv)
+	err = d.value(rv)
 	if err != nil {
 		return d.addErrorContext(err)
 	}
 	return d.savedError
 }
 
+// trackPaths reports whether the decoder needs the paths of the values it
+// decodes, for UnmarshalWithPresence or UnmarshalWithSpans.
+func (d *decodeState) trackPaths() bool {
+	return d.present != nil || d.spans != nil
+}
+
+// contextCheckInterval is the number of values decoded between checks of the
+// context passed to UnmarshalContext.
+const contextCheckInterval = 1024
+
+// checkContext returns the error of d.ctx, if any, checking it once every
+// contextCheckInterval calls.
+func (d *decodeState) checkContext() error {
+	if d.ctx == nil {
+		return nil
+	}
+	d.ctxValues++
+	if d.ctxValues%contextCheckInterval != 0 {
+		return nil
+	}
+	return d.ctx.Err()
+}
+
 func (d *decodeState) value(v reflect.Value) error {
+	if err := d.checkContext(); err != nil {
+		return err
+	}
+
 	switch d.opcode {
 	default:
 		panic(phasePanicMsg)
@@ -208,7 +514,7 @@ func (d *decodeState) value(v reflect.Value) error {
 			panic(phasePanicMsg)
 		}
 
-		start := d.readIndex()
+		start := d.stringStart()
 		d.scanWhile(scanContinue)
 
 		if v.IsValid() {
@@ -220,7 +526,12 @@ func (d *decodeState) value(v reflect.Value) error {
 	return nil
 }
 
-func indirect(v reflect.Value, decodingNull bool) (Unmarshaler, reflect.Value) {
+// indirect walks down v allocating pointers as needed, until it gets to a
+// non-pointer. If it encounters an Unmarshaler, indirect stops and returns
+// that. If it encounters an encoding.TextUnmarshaler, other than a
+// time.Time, which the decoder handles itself, indirect stops and returns
+// that instead.
+func indirect(v reflect.Value, decodingNull bool) (Unmarshaler, encoding.TextUnmarshaler, reflect.Value) {
 	v0 := v
 	haveAddr := false
 
@@ -248,10 +559,16 @@ func indirect(v reflect.Value, decodingNull bool) (Unmarshaler, reflect.Value) {
 		if v.IsNil() {
 			v.Set(reflect.New(v.Type().Elem()))
 		}
+		// Check for an Unmarshaler on the pointer itself, now that it has
+		// been allocated, rather than on the value it points to.
 		if v.Type().NumMethod() > 0 && v.CanInterface() {
-			// interfaces (Unarmasher)
 			if u, ok := v.Interface().(Unmarshaler); ok {
-				return u, reflect.Value{}
+				return u, nil, reflect.Value{}
+			}
+			if v.Type().Elem() != timeType {
+				if u, ok := v.Interface().(encoding.TextUnmarshaler); ok {
+					return nil, u, reflect.Value{}
+				}
 			}
 		}
 
@@ -262,21 +579,30 @@ func indirect(v reflect.Value, decodingNull bool) (Unmarshaler, reflect.Value) {
 			v = v.Elem()
 		}
 	}
-	return nil, v
+	return nil, nil, v
 }
 
 func (d *decodeState) list(v reflect.Value) error {
-	u, v := indirect(v, false)
+	u, ut, pv := indirect(v, false)
 	if u != nil {
 		start := d.readIndex()
 		d.skip()
 		return u.UnmarshalBencode(d.data[start:d.off])
 	}
+	if ut != nil {
+		d.saveError(&UnmarshalTypeError{Value: "list", Type: v.Type(), Offset: int64(d.off)})
+		d.skip()
+		return nil
+	}
+	v = pv
 
 	switch v.Kind() {
 	case reflect.Interface:
 		if v.NumMethod() == 0 {
-			li := d.listInterface()
+			li, err := d.listInterface()
+			if err != nil {
+				return err
+			}
 			v.Set(reflect.ValueOf(li))
 			return nil
 		}
@@ -289,7 +615,17 @@ func (d *decodeState) list(v reflect.Value) error {
 		break
 	}
 
+	if v.Kind() == reflect.Slice {
+		if ok, err := d.intList(v); ok {
+			return err
+		}
+	}
+
 	i := 0
+	if d.preserveSlices && v.Kind() == reflect.Slice {
+		i = v.Len()
+	}
+	start := i
 	d.scanNext()
 	for {
 		if d.opcode == scanEndList {
@@ -298,6 +634,9 @@ func (d *decodeState) list(v reflect.Value) error {
 		if d.opcode != scanBeginInteger && d.opcode != scanBeginList && d.opcode != scanBeginDictionary && d.opcode != scanBeginString { // todo
 			panic(phasePanicMsg)
 		}
+		if err := d.checkListLength(i - start); err != nil {
+			return err
+		}
 
 		if v.Kind() == reflect.Slice {
 			if i >= v.Cap() {
@@ -310,7 +649,10 @@ func (d *decodeState) list(v reflect.Value) error {
 				v.Set(newv)
 			}
 			if i >= v.Len() {
+				// The element may hold what an earlier decode left
+				// beyond the length of a reused slice.
 				v.SetLen(i + 1)
+				v.Index(i).Set(reflect.Zero(v.Type().Elem()))
 			}
 		}
 
@@ -327,56 +669,232 @@ func (d *decodeState) list(v reflect.Value) error {
 	}
 
 	if i < v.Len() {
-		if v.Kind() == reflect.Array {
-			z := reflect.Zero(v.Type().Elem())
-			for ; i < v.Len(); i++ {
-				v.Index(i).Set(z)
-			}
-		} else {
-			v.SetLen(i)
+		// Clear the elements past the end, so that neither an array nor
+		// the backing array of a truncated slice keeps them alive.
+		n := i
+		z := reflect.Zero(v.Type().Elem())
+		for ; i < v.Len(); i++ {
+			v.Index(i).Set(z)
+		}
+		if v.Kind() == reflect.Slice {
+			v.SetLen(n)
 		}
 	}
-	if i == 0 && v.Kind() == reflect.Slice {
+	if v.Kind() == reflect.Slice && v.IsNil() {
 		v.Set(reflect.MakeSlice(v.Type(), 0, 0))
 	}
 	return nil
 }
 
-func (d *decodeState) listInterface() []interface{} {
+// checkListLength reports an error if a list that already holds n elements
+// may not grow any further.
+func (d *decodeState) checkListLength(n int) error {
+	if d.maxListElements > 0 && n >= d.maxListElements {
+		return fmt.Errorf("bencode: list exceeds maximum of %d elements at offset %d", d.maxListElements, d.readIndex())
+	}
+	return nil
+}
+
+// countInterfaceNode counts a map, slice, string or integer created for an
+// interface value and returns an error once there are too many.
+func (d *decodeState) countInterfaceNode() error {
+	if d.maxInterfaceNodes <= 0 {
+		return nil
+	}
+	d.interfaceNodes++
+	if d.interfaceNodes > d.maxInterfaceNodes {
+		return fmt.Errorf("%w (%d) at offset %d", ErrTooManyInterfaceNodes, d.maxInterfaceNodes, d.readIndex())
+	}
+	return nil
+}
+
+func (d *decodeState) listInterface() ([]interface{}, error) {
+	if err := d.countInterfaceNode(); err != nil {
+		return nil, err
+	}
 	var v = make([]interface{}, 0)
 	d.scanNext()
-	for {
+	for d.opcode != scanEndList {
+		if d.opcode != scanBeginInteger && d.opcode != scanBeginList && d.opcode != scanBeginDictionary && d.opcode != scanBeginString {
+			panic(phasePanicMsg)
+		}
+		if err := d.checkListLength(len(v)); err != nil {
+			return nil, err
+		}
 		var e interface{}
-		d.value(reflect.ValueOf(&e))
+		if err := d.value(reflect.ValueOf(&e)); err != nil {
+			return nil, err
+		}
 		v = append(v, e)
-		if d.opcode == scanEndList {
-			break
+	}
+	return v, nil
+}
+
+// intList is a fast path of list for []int and []int64, the common shape of
+// lists of piece or file lengths. It parses integers directly and appends
+// them to the slice instead of decoding each through value. It reports
+// false, having consumed nothing, if v is a slice of any other type.
+func (d *decodeState) intList(v reflect.Value) (bool, error) {
+	if !v.CanAddr() {
+		return false, nil
+	}
+	var add func(n int64)
+	bits := 64
+	switch p := v.Addr().Interface().(type) {
+	case *[]int64:
+		add = func(n int64) { *p = append(*p, n) }
+	case *[]int:
+		add = func(n int64) { *p = append(*p, int(n)) }
+		bits = strconv.IntSize
+	default:
+		return false, nil
+	}
+
+	if !d.preserveSlices {
+		v.SetLen(0)
+	}
+	i := 0
+	d.scanNext()
+	for d.opcode != scanEndList {
+		if err := d.checkListLength(i); err != nil {
+			return true, err
 		}
-		if d.opcode != scanBeginInteger && d.opcode != scanBeginList && d.opcode != scanBeginDictionary && d.opcode != scanBeginString {
-			panic(phasePanicMsg)
+		if err := d.checkContext(); err != nil {
+			return true, err
+		}
+		i++
+
+		if d.opcode != scanBeginInteger {
+			// Let value deal with anything else, such as a string
+			// under StringsAsNumbers or a type error.
+			add(0)
+			if err := d.value(v.Index(v.Len() - 1)); err != nil {
+				return true, err
+			}
+			continue
 		}
+
+		d.scanNext()
+		start := d.readIndex()
+		d.scanWhile(scanContinue)
+		item := d.data[start:d.readIndex()]
+		n, ok := parseInt(item, bits)
+		if !ok {
+			d.saveError(&OverflowError{Value: string(item), Type: v.Type().Elem(), Offset: int64(d.readIndex())})
+		}
+		add(n)
+		d.scanNext()
 	}
-	return v
+
+	if v.IsNil() {
+		v.Set(reflect.MakeSlice(v.Type(), 0, 0))
+	}
+	return true, nil
+}
+
+// parseInt parses item, a decimal integer the scanner has already checked,
+// and reports whether it fits in a signed integer of the given size.
+func parseInt(item []byte, bits int) (int64, bool) {
+	neg := item[0] == '-'
+	if neg {
+		item = item[1:]
+	}
+	cutoff := uint64(1) << uint(bits-1)
+	var n uint64
+	for _, c := range item {
+		if n > cutoff/10 {
+			return 0, false
+		}
+		n = n*10 + uint64(c-'0')
+		if n > cutoff {
+			return 0, false
+		}
+	}
+	if !neg {
+		if n == cutoff {
+			return 0, false
+		}
+		return int64(n), true
+	}
+	return -int64(n), true
+}
+
+// listEach decodes the list held in d.data one element at a time. Each
+// element is decoded into a value returned by elem and handed to fn before
+// the next element is scanned. t is only used to report a non-list value.
+func (d *decodeState) listEach(t reflect.Type, elem func() reflect.Value, fn func(i int, v reflect.Value) error) (err error) {
+	defer recoverAbort(&err)
+
+	d.scan.reset()
+	d.scanNext()
+	if d.scan.bytes == 0 {
+		return io.EOF
+	}
+	if d.opcode != scanBeginList {
+		return &UnmarshalTypeError{Value: opcodeValueName(d.opcode), Type: t, Offset: int64(d.readIndex())}
+	}
+
+	d.scanNext()
+	for i := 0; d.opcode != scanEndList; i++ {
+		v := elem()
+		if err := d.value(v); err != nil {
+			return d.addErrorContext(err)
+		}
+		if d.savedError != nil {
+			return d.savedError
+		}
+		if err := fn(i, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func opcodeValueName(op int) string {
+	switch op {
+	case scanBeginDictionary:
+		return "dictionary"
+	case scanBeginList:
+		return "list"
+	case scanBeginInteger:
+		return "number"
+	}
+	return "string"
 }
 
 func (d *decodeState) dictionary(v reflect.Value) error {
-	u, v := indirect(v, false)
+	start := d.readIndex()
+
+	// The key filter of DecodeKeys applies to the outermost dictionary only.
+	only := d.onlyKeys
+	d.onlyKeys = nil
+
+	u, ut, pv := indirect(v, false)
 	if u != nil {
-		start := d.readIndex()
 		d.skip()
 		return u.UnmarshalBencode(d.data[start:d.off])
 	}
+	if ut != nil {
+		d.saveError(&UnmarshalTypeError{Value: "dictionary", Type: v.Type(), Offset: int64(d.off)})
+		d.skip()
+		return nil
+	}
+	v = pv
 
 	t := v.Type()
 
 	if v.Kind() == reflect.Interface && v.NumMethod() == 0 {
+		if err := d.countInterfaceNode(); err != nil {
+			return err
+		}
 		t = reflect.TypeOf(map[string]interface{}{})
-		n := reflect.New(t)
-		v.Set(n)
-		v = n.Elem()
+		m := reflect.MakeMap(t)
+		v.Set(m)
+		v = m
 	}
 
 	var fields []field
+	var seen []bool
 
 	switch v.Kind() {
 	case reflect.Map:
@@ -391,8 +909,23 @@ func (d *decodeState) dictionary(v reflect.Value) error {
 			v.Set(reflect.MakeMap(t))
 		}
 	case reflect.Struct:
-		fields = cachedTypeFields(t)
+		var err error
+		fields, err = cachedTypeFields(t)
+		if err != nil {
+			d.saveError(err)
+			d.skip()
+			return nil
+		}
+		seen = make([]bool, len(fields))
 		// ok
+	case reflect.Slice:
+		if isPairSlice(t) {
+			v.Set(v.Slice(0, 0))
+			break
+		}
+		d.saveError(&UnmarshalTypeError{Value: "dictionary", Type: t, Offset: int64(d.off)})
+		d.skip()
+		return nil
 	default:
 		d.saveError(&UnmarshalTypeError{Value: "dictionary", Type: t, Offset: int64(d.off)})
 		d.skip()
@@ -409,43 +942,66 @@ func (d *decodeState) dictionary(v reflect.Value) error {
 			break
 		}
 		if d.opcode != scanBeginString {
-			panic(phasePanicMsg)
+			return d.syntaxError("looking for dictionary key")
 		}
 		d.scanWhile(scanContinue)
 		if d.opcode != scanString {
-			panic(phasePanicMsg)
+			return d.syntaxError("in dictionary key")
 		}
 
-		start := d.readIndex()
+		start := d.stringStart()
 		d.scanWhile(scanContinue)
 		key := d.data[start:d.readIndex()]
 
+		// Every key must be followed by a value. The scanner guarantees
+		// this for checked input, but never let a dangling key reach value.
+		switch d.opcode {
+		case scanBeginDictionary, scanBeginList, scanBeginInteger, scanBeginString:
+		default:
+			return d.syntaxError("after dictionary key")
+		}
+
 		var subv reflect.Value
 		destring := false
-
-		if v.Kind() == reflect.Map {
+		path := d.path
+		field := false
+		numString := false
+		intString := false
+
+		// A key skipped by DecodeKeys is not looked up at all, so that it
+		// counts as absent for defaults, required fields and presence.
+		skipped := only != nil && !only[string(key)]
+
+		if skipped {
+			// Leave subv invalid so that the value is skipped.
+		} else if v.Kind() == reflect.Map {
+			if d.trackPaths() {
+				path += string(key)
+			}
+			// mapElem is reused for every value. It is zeroed first so
+			// that nothing of one value, such as a slice or pointer, is
+			// shared with the next; SetMapIndex stores a copy of it.
 			elemType := t.Elem()
+			intString = d.intMapStrings && elemType.Kind() == reflect.String
 			if !mapElem.IsValid() {
 				mapElem = reflect.New(elemType).Elem()
 			} else {
 				mapElem.Set(reflect.Zero(elemType))
 			}
 			subv = mapElem
+		} else if v.Kind() == reflect.Slice {
+			subv = reflect.New(t.Elem().Field(1).Type).Elem()
 		} else {
-			var f *field
-			for i := range fields {
-				ff := &fields[i]
-				if bytes.Equal(ff.nameBytes, key) {
-					f = ff
-					break
-				}
-				if f == nil && ff.equalFold(ff.nameBytes, key) {
-					f = ff
-				}
+			i := fieldByName(fields, key)
+			if i < 0 && d.nameMapper != nil {
+				i = fieldByName(fields, []byte(d.nameMapper(key)))
 			}
-			if f != nil {
+			if i >= 0 {
+				f := &fields[i]
+				seen[i] = true
 				subv = v
 				destring = f.quoted
+				numString = f.numString
 				for _, i := range f.index {
 					if subv.Kind() == reflect.Ptr {
 						if subv.IsNil() {
@@ -463,6 +1019,13 @@ func (d *decodeState) dictionary(v reflect.Value) error {
 				}
 				d.errorContext.Field = f.name
 				d.errorContext.Struct = t
+				if d.trackPaths() {
+					path += f.name
+					field = true
+				}
+				if d.present != nil {
+					d.present[path] = true
+				}
 			} else if d.disallowUnknownFields {
 				d.saveError(fmt.Errorf("bencode: unknown field %q", key))
 			}
@@ -472,6 +1035,13 @@ func (d *decodeState) dictionary(v reflect.Value) error {
 		//	panic(phasePanicMsg)
 		//}
 
+		originalPath := d.path
+		if d.trackPaths() {
+			d.path = path + "."
+		}
+		valueStart := d.readIndex()
+		d.numString = numString
+		d.intString = intString
 		if destring {
 			panic("not implemented")
 		} else {
@@ -479,13 +1049,24 @@ func (d *decodeState) dictionary(v reflect.Value) error {
 				return err
 			}
 		}
+		d.numString = false
+		d.intString = false
+		d.path = originalPath
+		if field && d.spans != nil {
+			d.spans[path] = [2]int{valueStart, d.readIndex()}
+		}
 
-		if v.Kind() == reflect.Map {
+		if skipped {
+			// Leave v as it is.
+		} else if v.Kind() == reflect.Map {
 			kt := t.Key()
 			var kv reflect.Value
 			switch {
 			case kt.Kind() == reflect.String:
-				kv = reflect.ValueOf(key).Convert(kt)
+				kv = d.mapKey(key)
+				if kt != kv.Type() {
+					kv = kv.Convert(kt)
+				}
 			//case interface
 			default:
 				panic("bencode: unexpected key type")
@@ -493,36 +1074,263 @@ func (d *decodeState) dictionary(v reflect.Value) error {
 			if kv.IsValid() {
 				v.SetMapIndex(kv, subv)
 			}
+		} else if v.Kind() == reflect.Slice {
+			kv := reflect.New(t.Elem()).Elem()
+			kv.Field(0).SetString(d.mapKey(key).String())
+			kv.Field(1).Set(subv)
+			v.Set(reflect.Append(v, kv))
 		}
 
 		if d.opcode == scanEndDictionary {
 			break
 		}
+		if d.opcode != scanBeginString {
+			return d.syntaxError("after dictionary value")
+		}
 
 		d.errorContext = originalErrorContext
 	}
+	d.errorContext = originalErrorContext
+
+	if d.requireFieldMatch && v.Kind() == reflect.Struct && only == nil {
+		d.checkFieldMatch(t, fields, seen, start)
+	}
+	if fields != nil {
+		d.checkRequired(t, fields, seen)
+		d.storeDefaults(v, fields, seen)
+		d.storeRaw(v, fields, d.data[start:d.off])
+	}
 	return nil
 }
 
-func (d *decodeState) convertNumber(s string) (interface{}, error) {
-	f, err := strconv.ParseFloat(s, 64)
+// storeRaw sets every field of the struct v with the "raw" tag option to a
+// copy of item, the dictionary v was decoded from.
+func (d *decodeState) storeRaw(v reflect.Value, fields []field, item []byte) {
+	for i := range fields {
+		f := &fields[i]
+		if !f.raw {
+			continue
+		}
+		fv := fieldValue(v, f.index)
+		if !fv.IsValid() {
+			continue
+		}
+		if fv.Kind() == reflect.Ptr {
+			if fv.IsNil() {
+				fv.Set(reflect.New(rawMessageType))
+			}
+			fv = fv.Elem()
+		}
+		fv.SetBytes(append([]byte{}, item...))
+	}
+}
+
+// storeDefaults sets every field of the struct v with the "default" tag
+// option that was not seen in the dictionary just decoded to its default.
+func (d *decodeState) storeDefaults(v reflect.Value, fields []field, seen []bool) {
+	for i := range fields {
+		f := &fields[i]
+		if !f.defaultValue.IsValid() || seen[i] {
+			continue
+		}
+		fv := fieldValue(v, f.index)
+		if !fv.IsValid() {
+			continue
+		}
+		if fv.Kind() == reflect.Ptr {
+			fv.Set(reflect.New(f.typ))
+			fv = fv.Elem()
+		}
+		fv.Set(f.defaultValue)
+	}
+}
+
+// fieldValue returns the field of the struct v with the given index,
+// allocating any nil embedded struct pointers on the way, or the zero Value
+// if one of them cannot be set.
+func fieldValue(v reflect.Value, index []int) reflect.Value {
+	for _, i := range index {
+		if v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				if !v.CanSet() {
+					return reflect.Value{}
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(i)
+	}
+	return v
+}
+
+// fieldByName returns the index of the field whose name matches key,
+// preferring an exact match over a case-insensitive one, or -1 if there is
+// none.
+func fieldByName(fields []field, key []byte) int {
+	f := -1
+	for i := range fields {
+		ff := &fields[i]
+		if ff.raw {
+			continue
+		}
+		if bytes.Equal(ff.nameBytes, key) {
+			return i
+		}
+		if f < 0 && ff.equalFold(ff.nameBytes, key) {
+			f = i
+		}
+	}
+	return f
+}
+
+// checkRequired saves an error naming every required field of the struct
+// type t that was not seen in the dictionary just decoded.
+func (d *decodeState) checkRequired(t reflect.Type, fields []field, seen []bool) {
+	var missing []string
+	for i := range fields {
+		if fields[i].required && !seen[i] {
+			missing = append(missing, strconv.Quote(fields[i].name))
+		}
+	}
+	if len(missing) > 0 {
+		d.saveError(fmt.Errorf("bencode: missing required field %s for Go struct %v", strings.Join(missing, ", "), t))
+	}
+}
+
+// checkFieldMatch saves an error if the non-empty dictionary at data[start]
+// was decoded into a struct of type t without setting any of its fields,
+// which usually means that the fields meant for its keys are unexported. A
+// struct with a field with the "raw" tag option always matches.
+func (d *decodeState) checkFieldMatch(t reflect.Type, fields []field, seen []bool, start int) {
+	if d.data[start+1] == 'e' {
+		return
+	}
+	for i := range fields {
+		if seen[i] || fields[i].raw {
+			return
+		}
+	}
+	d.saveError(fmt.Errorf("bencode: no key of dictionary at offset %d matches an exported field of Go struct %v", start, t))
+}
+
+// StringSink receives the contents of a bencode string by writing them to W
+// instead of storing them, for instance to hash a torrent's pieces field
+// without keeping a copy.
+//
+// A Decoder streams the string into W in chunks as it reads it, so memory
+// use does not depend on the string's declared length, as long as the
+// StringSink is reached from the value passed to Decode only through struct
+// fields and pointers. The other values of those structs are buffered and
+// decoded as usual. A struct with a field with the "raw" tag option, or a
+// StringSink inside a map, slice or interface, needs its whole value
+// buffered, in which case W receives the string in one Write, as it always
+// does with Unmarshal.
+type StringSink struct {
+	W io.Writer `bencode:"-"`
+}
+
+var (
+	stringSinkType      = reflect.TypeOf(StringSink{})
+	unmarshalerType     = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+var streamSinkCache sync.Map // map[reflect.Type]bool
+
+// streamsSink reports whether a value of type t can hold a StringSink that
+// a Decoder streams into, reached only through struct fields and pointers.
+func streamsSink(t reflect.Type) bool {
+	if b, ok := streamSinkCache.Load(t); ok {
+		return b.(bool)
+	}
+	b := typeStreamsSink(t, map[reflect.Type]bool{})
+	streamSinkCache.Store(t, b)
+	return b
+}
+
+func typeStreamsSink(t reflect.Type, visiting map[reflect.Type]bool) bool {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == stringSinkType {
+		return true
+	}
+	if t.Kind() != reflect.Struct || visiting[t] || reflect.PtrTo(t).Implements(unmarshalerType) || reflect.PtrTo(t).Implements(textUnmarshalerType) {
+		return false
+	}
+	visiting[t] = true
+	fields, err := cachedTypeFields(t)
 	if err != nil {
-		return nil, &UnmarshalTypeError{Value: "number " + s, Type: reflect.TypeOf(0.0), Offset: int64(d.off)}
+		return false
+	}
+	found := false
+	for i := range fields {
+		if fields[i].raw {
+			return false
+		}
+		if typeStreamsSink(typeByIndex(t, fields[i].index), visiting) {
+			found = true
+		}
 	}
-	return f, nil
+	return found
+}
+
+// A Number represents a bencode integer literal. Marshal encodes a Number as
+// the integer it holds, even inside an interface{}, so wrapping a string in a
+// Number emits it as an integer rather than a string.
+type Number string
+
+// String returns the literal text of the number.
+func (n Number) String() string { return string(n) }
+
+// Int64 returns the number as an int64.
+func (n Number) Int64() (int64, error) {
+	return strconv.ParseInt(string(n), 10, 64)
+}
+
+// Uint64 returns the number as a uint64. It is an error for the number to be
+// negative.
+func (n Number) Uint64() (uint64, error) {
+	return strconv.ParseUint(string(n), 10, 64)
+}
+
+var numberType = reflect.TypeOf(Number(""))
+
+// convertNumber converts the number literal s to the int64 or Number stored
+// in an interface{}. A literal out of the range of int64 is stored as a
+// Number even without UseNumber.
+func (d *decodeState) convertNumber(s string) interface{} {
+	if d.useNumber {
+		return Number(s)
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return Number(s)
+	}
+	return n
 }
 
 func (d *decodeState) integerStore(item []byte, v reflect.Value, fromQuoted bool) error {
+	// The scanner rejects ie, and StringsAsNumbers checks isDecimal, so only
+	// a ,string-tagged value can be empty here.
 	if len(item) == 0 {
-		d.saveError(fmt.Errorf("bencode: invalid use of ,string struct tag, trying to unmarshal %q into %v", item, v.Type()))
-		return nil
+		if fromQuoted {
+			d.saveError(fmt.Errorf("bencode: invalid use of ,string struct tag, trying to unmarshal %q into %v", item, v.Type()))
+			return nil
+		}
+		panic(phasePanicMsg)
 	}
 
-	u, v := indirect(v, false)
+	u, ut, pv := indirect(v, false)
 	if u != nil {
 		return u.UnmarshalBencode(append(append([]byte{'i'}, item...), 'e'))
 	}
-
+	if ut != nil {
+		d.saveError(&UnmarshalTypeError{Value: "number", Type: v.Type(), Offset: int64(d.readIndex())})
+		return nil
+	}
+	v = pv
 
 	c := item[0]
 	if c != '-' && (c < '0' || c > '9') {
@@ -539,27 +1347,32 @@ func (d *decodeState) integerStore(item []byte, v reflect.Value, fromQuoted bool
 		}
 		d.saveError(&UnmarshalTypeError{Value: "number", Type: v.Type(), Offset: int64(d.readIndex())})
 	case reflect.Interface:
-		n, err := d.convertNumber(s)
-		if err != nil {
-			d.saveError(err)
-			break
-		}
+		n := d.convertNumber(s)
 		if v.NumMethod() != 0 {
 			d.saveError(&UnmarshalTypeError{Value: "number", Type: v.Type(), Offset: int64(d.readIndex())})
 			break
 		}
+		if err := d.countInterfaceNode(); err != nil {
+			return err
+		}
 		v.Set(reflect.ValueOf(n))
+	case reflect.String:
+		if v.Type() != numberType && !d.intString {
+			d.saveError(&UnmarshalTypeError{Value: "number", Type: v.Type(), Offset: int64(d.readIndex())})
+			break
+		}
+		v.SetString(s)
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
 		n, err := strconv.ParseInt(s, 10, 64)
 		if err != nil || v.OverflowInt(n) {
-			d.saveError(&UnmarshalTypeError{Value: "number " + s, Type: v.Type(), Offset: int64(d.readIndex())})
+			d.saveError(&OverflowError{Value: s, Type: v.Type(), Offset: int64(d.readIndex())})
 			break
 		}
 		v.SetInt(n)
-	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint64, reflect.Uintptr:
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
 		n, err := strconv.ParseUint(s, 10, 64)
 		if err != nil || v.OverflowUint(n) {
-			d.saveError(&UnmarshalTypeError{Value: "number " + s, Type: v.Type(), Offset: int64(d.readIndex())})
+			d.saveError(&OverflowError{Value: s, Type: v.Type(), Offset: int64(d.readIndex())})
 			break
 		}
 		v.SetUint(n)
@@ -570,10 +1383,17 @@ func (d *decodeState) integerStore(item []byte, v reflect.Value, fromQuoted bool
 			break
 		}
 		v.SetFloat(n)
+	case reflect.Struct:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if v.Type() != timeType || err != nil {
+			d.saveError(&UnmarshalTypeError{Value: "number " + s, Type: v.Type(), Offset: int64(d.readIndex())})
+			break
+		}
+		v.Set(reflect.ValueOf(time.Unix(n, 0).UTC()))
 	case reflect.Bool:
 		n, err := strconv.ParseUint(s, 10, 64)
 		if err != nil || n > 1 {
-			d.saveError(&UnmarshalTypeError{Value: "number "+s, Type: v.Type(), Offset: int64(d.readIndex())})
+			d.saveError(&UnmarshalTypeError{Value: "number " + s, Type: v.Type(), Offset: int64(d.readIndex())})
 			break
 		}
 		v.SetBool(n == 1)
@@ -582,36 +1402,87 @@ func (d *decodeState) integerStore(item []byte, v reflect.Value, fromQuoted bool
 }
 
 func (d *decodeState) stringStore(item []byte, v reflect.Value, fromQuoted bool) error {
-	if len(item) == 0 {
+	// Only a ,string-tagged value may not be empty; the empty string 0:
+	// is otherwise a legitimate value.
+	if len(item) == 0 && fromQuoted {
 		d.saveError(fmt.Errorf("bencode: invalid use of ,string struct tag, trying to unmarshal %q into %v", item, v.Type()))
 		return nil
 	}
 
-	u, v := indirect(v, false)
+	u, ut, pv := indirect(v, false)
 	if u != nil {
 		return u.UnmarshalBencode(append([]byte(strconv.Itoa(len(item))+":"), item...))
 	}
+	if ut != nil {
+		return ut.UnmarshalText(item)
+	}
+	v = pv
+
+	if v.Type() == stringSinkType {
+		w := v.Interface().(StringSink).W
+		if w == nil {
+			d.saveError(errors.New("bencode: StringSink with nil Writer"))
+			return nil
+		}
+		_, err := w.Write(item)
+		return err
+	}
+
+	if (d.stringsAsNumbers || d.numString) && isNumberKind(v.Kind()) {
+		if !isDecimal(item) {
+			d.saveError(&UnmarshalTypeError{Value: "string", Type: v.Type(), Offset: int64(d.readIndex())})
+			return nil
+		}
+		return d.integerStore(item, v, false)
+	}
 
 	s := string(item)
 	switch v.Kind() {
 	default:
 		d.saveError(&UnmarshalTypeError{Value: "string", Type: v.Type(), Offset: int64(d.readIndex())})
+	case reflect.Struct:
+		if v.Type() != timeType {
+			d.saveError(&UnmarshalTypeError{Value: "string", Type: v.Type(), Offset: int64(d.readIndex())})
+			break
+		}
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			d.saveError(fmt.Errorf("bencode: cannot unmarshal string %q into Go value of type time.Time: %v", s, err))
+			break
+		}
+		v.Set(reflect.ValueOf(t.UTC()))
 	case reflect.Slice:
+		if et := v.Type().Elem(); isByteArray(et) && et.Len() > 0 {
+			n := et.Len()
+			if len(item)%n != 0 {
+				d.saveError(&UnmarshalTypeError{Value: "string of length " + strconv.Itoa(len(item)), Type: v.Type(), Offset: int64(d.readIndex())})
+				break
+			}
+			sv := reflect.MakeSlice(v.Type(), len(item)/n, len(item)/n)
+			for i := 0; i < sv.Len(); i++ {
+				reflect.Copy(sv.Index(i), reflect.ValueOf(item[i*n:(i+1)*n]))
+			}
+			v.Set(sv)
+			break
+		}
 		if v.Type().Elem().Kind() != reflect.Uint8 {
 			d.saveError(&UnmarshalTypeError{Value: "string", Type: v.Type(), Offset: int64(d.readIndex())})
 			break
 		}
-		b := make([]byte, base64.StdEncoding.DecodedLen(len(s)))
-		n, err := base64.StdEncoding.Decode(b, []byte(s))
-		if err != nil {
-			d.saveError(err)
+		v.SetBytes(append([]byte{}, item...))
+	case reflect.Array:
+		if v.Type().Elem().Kind() != reflect.Uint8 || v.Len() != len(item) {
+			d.saveError(&UnmarshalTypeError{Value: "string", Type: v.Type(), Offset: int64(d.readIndex())})
 			break
 		}
-		v.SetBytes(b[:n])
+		reflect.Copy(v, reflect.ValueOf(item))
 	case reflect.String:
 		v.SetString(string(s))
 	case reflect.Interface:
 		if v.NumMethod() == 0 {
+			if err := d.countInterfaceNode(); err != nil {
+				return err
+			}
 			v.Set(reflect.ValueOf(string(s)))
 		} else {
 			d.saveError(&UnmarshalTypeError{Value: "string", Type: v.Type(), Offset: int64(d.readIndex())})
@@ -619,3 +1490,29 @@ func (d *decodeState) stringStore(item []byte, v reflect.Value, fromQuoted bool)
 	}
 	return nil
 }
+
+func isNumberKind(k reflect.Kind) bool {
+	switch k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// isDecimal reports whether b is an optionally negative decimal integer.
+func isDecimal(b []byte) bool {
+	if len(b) > 0 && b[0] == '-' {
+		b = b[1:]
+	}
+	if len(b) == 0 {
+		return false
+	}
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -1,6 +1,15 @@
 package bencode
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -26,3 +35,1184 @@ func TestUnmarshal(t *testing.T) {
 		t.Error("Int")
 	}
 }
+
+func TestUnmarshalUint32(t *testing.T) {
+	var data struct {
+		N uint32 `bencode:"n"`
+	}
+
+	if err := Unmarshal([]byte(`d1:ni4000000000ee`), &data); err != nil {
+		t.Fatal(err)
+	}
+	if data.N != 4000000000 {
+		t.Errorf("N = %d, want 4000000000", data.N)
+	}
+
+	err := Unmarshal([]byte(`d1:ni4294967296ee`), &data)
+	if _, ok := err.(*OverflowError); !ok {
+		t.Errorf("Unmarshal of 2^32 into uint32 = %v, want *OverflowError", err)
+	}
+}
+
+var integerWidthTests = []struct {
+	typ      reflect.Type
+	min, max string
+	under    string
+	over     string
+}{
+	{reflect.TypeOf(int(0)), "-9223372036854775808", "9223372036854775807", "-9223372036854775809", "9223372036854775808"},
+	{reflect.TypeOf(int8(0)), "-128", "127", "-129", "128"},
+	{reflect.TypeOf(int16(0)), "-32768", "32767", "-32769", "32768"},
+	{reflect.TypeOf(int32(0)), "-2147483648", "2147483647", "-2147483649", "2147483648"},
+	{reflect.TypeOf(int64(0)), "-9223372036854775808", "9223372036854775807", "-9223372036854775809", "9223372036854775808"},
+	{reflect.TypeOf(uint(0)), "0", "18446744073709551615", "-1", "18446744073709551616"},
+	{reflect.TypeOf(uint8(0)), "0", "255", "-1", "256"},
+	{reflect.TypeOf(uint16(0)), "0", "65535", "-1", "65536"},
+	{reflect.TypeOf(uint32(0)), "0", "4294967295", "-1", "4294967296"},
+	{reflect.TypeOf(uint64(0)), "0", "18446744073709551615", "-1", "18446744073709551616"},
+	{reflect.TypeOf(uintptr(0)), "0", "18446744073709551615", "-1", "18446744073709551616"},
+}
+
+func TestUnmarshalByteSlice(t *testing.T) {
+	// Strings decode byte for byte, without base64 decoding.
+	for _, want := range []string{"aGk=", "\xff\x00a", ""} {
+		var b []byte
+		in := strconv.Itoa(len(want)) + ":" + want
+		if err := Unmarshal([]byte(in), &b); err != nil {
+			t.Errorf("Unmarshal(%q): %v", in, err)
+			continue
+		}
+		if string(b) != want {
+			t.Errorf("Unmarshal(%q) = %q, want %q", in, b, want)
+		}
+	}
+}
+
+func TestUnmarshalIntegerWidths(t *testing.T) {
+	for _, tt := range integerWidthTests {
+		if tt.typ.Size() < 8 && (tt.typ.Kind() == reflect.Int || tt.typ.Kind() == reflect.Uint || tt.typ.Kind() == reflect.Uintptr) {
+			t.Logf("skipping %v on a 32-bit platform", tt.typ)
+			continue
+		}
+		for _, s := range []string{tt.min, tt.max} {
+			v := reflect.New(tt.typ)
+			if err := Unmarshal([]byte("i"+s+"e"), v.Interface()); err != nil {
+				t.Errorf("Unmarshal(i%se) into %v: %v", s, tt.typ, err)
+				continue
+			}
+			if got := fmt.Sprint(v.Elem().Interface()); got != s {
+				t.Errorf("Unmarshal(i%se) into %v = %s", s, tt.typ, got)
+			}
+		}
+		for _, s := range []string{tt.under, tt.over} {
+			v := reflect.New(tt.typ)
+			err := Unmarshal([]byte("i"+s+"e"), v.Interface())
+			if _, ok := err.(*OverflowError); !ok {
+				t.Errorf("Unmarshal(i%se) into %v = %v, want *OverflowError", s, tt.typ, err)
+			}
+		}
+	}
+}
+
+func TestUnmarshalAnnounceList(t *testing.T) {
+	var data struct {
+		AnnounceList [][]string `bencode:"announce-list"`
+		After        int        `bencode:"z"`
+	}
+
+	in := `d13:announce-listll30:http://tracker.example.org:80/30:udp://tracker.example.org:6969el29:http://backup.example.org:80/elee1:zi1ee`
+	if err := Unmarshal([]byte(in), &data); err != nil {
+		t.Fatal(err)
+	}
+
+	want := [][]string{
+		{"http://tracker.example.org:80/", "udp://tracker.example.org:6969"},
+		{"http://backup.example.org:80/"},
+		{},
+	}
+	if !reflect.DeepEqual(data.AnnounceList, want) {
+		t.Errorf("AnnounceList = %q, want %q", data.AnnounceList, want)
+	}
+	if data.After != 1 {
+		t.Errorf("key after nested lists decoded as %d, want 1", data.After)
+	}
+}
+
+// mutations returns every input that differs from seed by replacing,
+// inserting or deleting a single byte from a small bencode alphabet.
+func mutations(seed string) []string {
+	const alphabet = "dlie0123:-ax"
+	var out []string
+	for i := 0; i <= len(seed); i++ {
+		if i < len(seed) {
+			out = append(out, seed[:i]+seed[i+1:])
+		}
+		for j := 0; j < len(alphabet); j++ {
+			c := string(alphabet[j])
+			out = append(out, seed[:i]+c+seed[i:])
+			if i < len(seed) {
+				out = append(out, seed[:i]+c+seed[i+1:])
+			}
+		}
+	}
+	return out
+}
+
+var mutationSeeds = []string{
+	`d1:ali0eee`,
+	`d1:ad1:bi1ee1:c0:e`,
+	`ld0:0:e0:e`,
+	`d3:barli1ei2ei3ee3:foo3:baz3:Inti42ee`,
+}
+
+func TestUnmarshalMutations(t *testing.T) {
+	type target struct {
+		A   interface{} `bencode:"a"`
+		B   int         `bencode:"b"`
+		C   string      `bencode:"c"`
+		Bar []int       `bencode:"bar"`
+		Foo string      `bencode:"foo"`
+		Int uint8
+	}
+
+	for _, seed := range mutationSeeds {
+		for _, data := range mutations(seed) {
+			valid := Valid([]byte(data))
+			for _, v := range []interface{}{new(interface{}), new(map[string]interface{}), new(target), new([]interface{})} {
+				err := Unmarshal([]byte(data), v)
+				if !valid && err == nil {
+					t.Errorf("Unmarshal(%#q, %T) accepted invalid input", data, v)
+				}
+			}
+		}
+	}
+}
+
+func TestUnmarshalRequired(t *testing.T) {
+	type announce struct {
+		InfoHash []byte `bencode:"info_hash,required"`
+		PeerID   []byte `bencode:"peer_id,required"`
+		Port     int    `bencode:"port"`
+	}
+
+	var v announce
+	if err := Unmarshal([]byte(`d9:info_hash1:a7:peer_id1:be`), &v); err != nil {
+		t.Errorf("Unmarshal with all required fields: %v", err)
+	}
+
+	v = announce{}
+	err := Unmarshal([]byte(`d4:porti6881ee`), &v)
+	if err == nil {
+		t.Fatal("Unmarshal accepted missing required fields")
+	}
+	if msg := err.Error(); !strings.Contains(msg, `"info_hash"`) || !strings.Contains(msg, `"peer_id"`) {
+		t.Errorf("error %q does not name every missing field", msg)
+	}
+	if v.Port != 6881 {
+		t.Errorf("Port = %d, want 6881", v.Port)
+	}
+}
+
+func TestUnmarshalOrderedMap(t *testing.T) {
+	var v struct {
+		Info OrderedMap `bencode:"info"`
+	}
+	v.Info = OrderedMap{{"stale", 1}}
+
+	in := `d4:infod4:name3:foo6:lengthi3e5:filesl1:aeee`
+	if err := Unmarshal([]byte(in), &v); err != nil {
+		t.Fatal(err)
+	}
+
+	want := OrderedMap{
+		{"name", "foo"},
+		{"length", int64(3)},
+		{"files", []interface{}{"a"}},
+	}
+	if !reflect.DeepEqual(v.Info, want) {
+		t.Errorf("Info = %#v, want %#v", v.Info, want)
+	}
+
+	if err := Unmarshal([]byte(`li1ee`), &v.Info); err == nil {
+		t.Error("Unmarshal of a list into OrderedMap succeeded")
+	}
+}
+
+func TestUnmarshalStringSink(t *testing.T) {
+	h := sha1.New()
+	v := struct {
+		Name   string     `bencode:"name"`
+		Pieces StringSink `bencode:"pieces"`
+	}{Pieces: StringSink{W: h}}
+
+	if err := Unmarshal([]byte(`d4:name3:foo6:pieces6:abcdefe`), &v); err != nil {
+		t.Fatal(err)
+	}
+	if want := sha1.Sum([]byte("abcdef")); !bytes.Equal(h.Sum(nil), want[:]) {
+		t.Errorf("sink received data hashing to %x", h.Sum(nil))
+	}
+	if v.Name != "foo" {
+		t.Errorf("Name = %q", v.Name)
+	}
+
+	if err := Unmarshal([]byte(`d6:piecesi1ee`), &v); err == nil {
+		t.Error("Unmarshal of an integer into a StringSink succeeded")
+	}
+	if err := Unmarshal([]byte(`3:abc`), new(StringSink)); err == nil {
+		t.Error("Unmarshal into a StringSink without a Writer succeeded")
+	}
+}
+
+func TestUnmarshalListClosingDictionary(t *testing.T) {
+	const in = `d1:ali0eee`
+
+	var m map[string]interface{}
+	if err := Unmarshal([]byte(in), &m); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]interface{}{"a": []interface{}{int64(0)}}; !reflect.DeepEqual(m, want) {
+		t.Errorf("map = %#v, want %#v", m, want)
+	}
+
+	var s struct {
+		A []int `bencode:"a"`
+	}
+	if err := Unmarshal([]byte(in), &s); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.A) != 1 || s.A[0] != 0 {
+		t.Errorf("struct = %+v", s)
+	}
+
+	var l []map[string][]int
+	if err := Unmarshal([]byte(`l`+in+`d1:blee`+`e`), &l); err != nil {
+		t.Fatal(err)
+	}
+	if len(l) != 2 || len(l[0]["a"]) != 1 || l[1]["b"] == nil {
+		t.Errorf("list = %#v", l)
+	}
+}
+
+func TestUnmarshalIntegerWidthsIndirect(t *testing.T) {
+	for _, tt := range integerWidthTests {
+		if tt.typ.Size() < 8 && (tt.typ.Kind() == reflect.Int || tt.typ.Kind() == reflect.Uint || tt.typ.Kind() == reflect.Uintptr) {
+			continue
+		}
+
+		m := reflect.New(reflect.MapOf(reflect.TypeOf(""), tt.typ))
+		if err := Unmarshal([]byte("d3:maxi"+tt.max+"e3:mini"+tt.min+"ee"), m.Interface()); err != nil {
+			t.Errorf("Unmarshal into map of %v: %v", tt.typ, err)
+		} else if got := fmt.Sprint(m.Elem().MapIndex(reflect.ValueOf("max"))); got != tt.max {
+			t.Errorf("map of %v holds max %s, want %s", tt.typ, got, tt.max)
+		}
+		if err := Unmarshal([]byte("d3:maxi"+tt.over+"ee"), m.Interface()); err == nil {
+			t.Errorf("Unmarshal of %s into map of %v succeeded", tt.over, tt.typ)
+		}
+
+		l := reflect.New(reflect.SliceOf(reflect.PtrTo(tt.typ)))
+		if err := Unmarshal([]byte("li"+tt.min+"ei"+tt.max+"ee"), l.Interface()); err != nil {
+			t.Errorf("Unmarshal into list of *%v: %v", tt.typ, err)
+		} else if got := fmt.Sprint(l.Elem().Index(1).Elem()); got != tt.max {
+			t.Errorf("list of *%v holds max %s, want %s", tt.typ, got, tt.max)
+		}
+		if err := Unmarshal([]byte("li"+tt.under+"ee"), l.Interface()); err == nil {
+			t.Errorf("Unmarshal of %s into list of *%v succeeded", tt.under, tt.typ)
+		}
+	}
+}
+
+func TestUnmarshalWithPresence(t *testing.T) {
+	var v struct {
+		Announce string `bencode:"announce"`
+		Comment  string `bencode:"comment"`
+		Info     struct {
+			Name    string `bencode:"name"`
+			Private bool   `bencode:"private"`
+		} `bencode:"info"`
+		Extra map[string]struct {
+			N int `bencode:"n"`
+		} `bencode:"extra"`
+		Files []struct {
+			Length int64 `bencode:"length"`
+		} `bencode:"files"`
+	}
+
+	in := `d8:announce0:5:extrad1:xd1:ni1eee5:filesld6:lengthi1eee4:infod7:privatei0eee`
+	present, err := UnmarshalWithPresence([]byte(in), &v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]bool{
+		"announce":     true,
+		"extra":        true,
+		"extra.x.n":    true,
+		"files":        true,
+		"files.length": true,
+		"info":         true,
+		"info.private": true,
+	}
+	if !reflect.DeepEqual(present, want) {
+		t.Errorf("present = %v, want %v", present, want)
+	}
+}
+
+func TestUnmarshalRawField(t *testing.T) {
+	type info struct {
+		Name string     `bencode:"name"`
+		Raw  RawMessage `bencode:",raw"`
+	}
+	var v struct {
+		Info  info   `bencode:"info"`
+		Infos []info `bencode:"infos"`
+	}
+
+	const first, second = `d4:name1:a3:rawi1ee`, `de`
+	in := `d4:info` + first + `5:infosl` + first + second + `ee`
+	if err := Unmarshal([]byte(in), &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Info.Name != "a" || string(v.Info.Raw) != first {
+		t.Errorf("Info = %+v", v.Info)
+	}
+	if len(v.Infos) != 2 || string(v.Infos[0].Raw) != first || string(v.Infos[1].Raw) != second {
+		t.Errorf("Infos = %q", v.Infos)
+	}
+
+	b, err := Marshal(v.Info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != `d4:name1:ae` {
+		t.Errorf("Marshal = %#q", b)
+	}
+}
+
+func TestUnmarshalRawPointerField(t *testing.T) {
+	var v struct {
+		A   int         `bencode:"a"`
+		Raw *RawMessage `bencode:",raw"`
+	}
+	const in = `d1:ai1ee`
+	if err := Unmarshal([]byte(in), &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.A != 1 || v.Raw == nil || string(*v.Raw) != in {
+		t.Errorf("v = %+v", v)
+	}
+
+	b, err := Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != in {
+		t.Errorf("Marshal = %#q, want %#q", b, in)
+	}
+}
+
+func TestDecodeDanglingDictionaryKey(t *testing.T) {
+	type target struct {
+		A int         `bencode:"a"`
+		B interface{} `bencode:"b"`
+	}
+
+	// Each input is a valid seed with the value of one key removed.
+	for _, in := range []string{
+		`d1:ae`,
+		`d1:ai1e1:be`,
+		`d1:bd1:cee`,
+		`d1:bld1:ceee`,
+		`ld1:aee`,
+		`d1:a0:1:bd1:cd1:deee`,
+	} {
+		for _, v := range []interface{}{new(interface{}), new(map[string]interface{}), new(target)} {
+			func() {
+				defer func() {
+					if r := recover(); r != nil {
+						t.Errorf("decoding %#q into %T panicked: %v", in, v, r)
+					}
+				}()
+				// Bypass checkValid so that dictionary sees input the
+				// scanner would have rejected.
+				var d decodeState
+				d.init([]byte(in))
+				if err := d.unmarshal(v); err == nil {
+					t.Errorf("decoding %#q into %T succeeded", in, v)
+				}
+			}()
+		}
+	}
+}
+
+// magnet is a named string type that validates and normalizes its text.
+type magnet string
+
+func (m *magnet) UnmarshalText(text []byte) error {
+	const prefix = "magnet:?"
+	if !bytes.HasPrefix(text, []byte(prefix)) {
+		return fmt.Errorf("not a magnet link: %q", text)
+	}
+	*m = magnet(strings.ToLower(string(text)))
+	return nil
+}
+
+func TestUnmarshalTextUnmarshaler(t *testing.T) {
+	var v struct {
+		Link  magnet   `bencode:"link"`
+		Links []magnet `bencode:"links"`
+	}
+	in := `d4:link21:magnet:?xt=urn:BTIH:A5:linksl11:magnet:?X=Yee`
+	if err := Unmarshal([]byte(in), &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Link != "magnet:?xt=urn:btih:a" || len(v.Links) != 1 || v.Links[0] != "magnet:?x=y" {
+		t.Errorf("Unmarshal = %+v", v)
+	}
+
+	if err := Unmarshal([]byte(`d4:link4:httpe`), &v); err == nil {
+		t.Error("Unmarshal accepted an invalid magnet link")
+	}
+	if err := Unmarshal([]byte(`d4:linki1ee`), &v); err == nil {
+		t.Error("Unmarshal accepted an integer for a TextUnmarshaler")
+	}
+}
+
+func TestUnmarshalIntList(t *testing.T) {
+	const in = `li-9223372036854775808ei0ei9223372036854775807ee`
+	var list []int64
+	if err := Unmarshal([]byte(in), &list); err != nil {
+		t.Fatal(err)
+	}
+	if want := []int64{-1 << 63, 0, 1<<63 - 1}; !reflect.DeepEqual(list, want) {
+		t.Errorf("Unmarshal = %v, want %v", list, want)
+	}
+
+	ints := []int{7, 8, 9, 10}
+	if err := Unmarshal([]byte(`li1ei2ee`), &ints); err != nil || !reflect.DeepEqual(ints, []int{1, 2}) {
+		t.Errorf("Unmarshal = %v, %v", ints, err)
+	}
+	if err := Unmarshal([]byte(`le`), &ints); err != nil || ints == nil || len(ints) != 0 {
+		t.Errorf("Unmarshal of empty list = %#v, %v", ints, err)
+	}
+
+	// Errors must match those of the generic path.
+	for _, in := range []string{`li9223372036854775808ee`, `li-9223372036854775809ee`, `li1e1:ai2ee`, `li1eli2eee`} {
+		var fast []int64
+		var generic []benchInt64
+		errFast := Unmarshal([]byte(in), &fast)
+		errGeneric := Unmarshal([]byte(in), &generic)
+		if errFast == nil || errGeneric == nil || errFast.Error() != strings.Replace(errGeneric.Error(), "bencode.benchInt64", "int64", -1) {
+			t.Errorf("Unmarshal(%#q) = %v, generic path %v", in, errFast, errGeneric)
+		}
+	}
+
+	dec := NewDecoder(strings.NewReader(`li1e1:2i3ee`))
+	dec.StringsAsNumbers()
+	dec.PreserveExistingSlices()
+	list = []int64{0}
+	if err := dec.Decode(&list); err != nil || !reflect.DeepEqual(list, []int64{0, 1, 2, 3}) {
+		t.Errorf("Decode = %v, %v", list, err)
+	}
+}
+
+func TestUnmarshalTopLevelPointers(t *testing.T) {
+	type T struct {
+		A int `bencode:"a"`
+	}
+
+	var nilT *T
+	err := Unmarshal([]byte(`d1:ai1ee`), nilT)
+	if _, ok := err.(*InvalidUnmarshalError); !ok {
+		t.Errorf("Unmarshal into nil *T = %v, want InvalidUnmarshalError", err)
+	}
+	err = Unmarshal([]byte(`d1:ai1ee`), (**T)(nil))
+	if _, ok := err.(*InvalidUnmarshalError); !ok {
+		t.Errorf("Unmarshal into nil **T = %v, want InvalidUnmarshalError", err)
+	}
+
+	var p *T
+	if err := Unmarshal([]byte(`d1:ai1ee`), &p); err != nil {
+		t.Fatal(err)
+	}
+	if p == nil || p.A != 1 {
+		t.Errorf("Unmarshal into **T allocated %+v", p)
+	}
+
+	var pp **int
+	if err := Unmarshal([]byte(`i2e`), &pp); err != nil {
+		t.Fatal(err)
+	}
+	if pp == nil || *pp == nil || **pp != 2 {
+		t.Error("Unmarshal into ***int did not allocate")
+	}
+}
+
+func TestUnmarshalOverflowError(t *testing.T) {
+	var v struct {
+		N int8 `bencode:"n"`
+	}
+	err := Unmarshal([]byte(`d1:ni300ee`), &v)
+	oe, ok := err.(*OverflowError)
+	if !ok {
+		t.Fatalf("Unmarshal of 300 into int8 = %v, want *OverflowError", err)
+	}
+	if oe.Value != "300" || oe.Type != reflect.TypeOf(int8(0)) || oe.Field != "n" || oe.Offset != 8 {
+		t.Errorf("OverflowError = %+v", oe)
+	}
+
+	// An interface{} holds integers out of the range of int64 as a Number.
+	var x interface{}
+	if err := Unmarshal([]byte(`d1:xi123456789012345678901234567890ee`), &x); err != nil {
+		t.Errorf("Unmarshal of a big integer into interface{}: %v", err)
+	} else if want := map[string]interface{}{"x": Number("123456789012345678901234567890")}; !reflect.DeepEqual(x, want) {
+		t.Errorf("Unmarshal of a big integer into interface{} = %#v, want %#v", x, want)
+	}
+
+	// A type mismatch is not an overflow.
+	if err := Unmarshal([]byte(`d1:n3:fooe`), &v); err == nil {
+		t.Error("Unmarshal of string into int8 succeeded")
+	} else if _, ok := err.(*UnmarshalTypeError); !ok {
+		t.Errorf("Unmarshal of string into int8 = %v, want *UnmarshalTypeError", err)
+	}
+}
+
+// countingUnmarshaler records the raw values it is asked to decode.
+type countingUnmarshaler struct {
+	raw []string
+}
+
+func (u *countingUnmarshaler) UnmarshalBencode(data []byte) error {
+	u.raw = append(u.raw, string(data))
+	return nil
+}
+
+func TestUnmarshalPointerFieldUnmarshaler(t *testing.T) {
+	type T struct {
+		P *countingUnmarshaler `bencode:"p"`
+		V countingUnmarshaler  `bencode:"v"`
+	}
+
+	var v T
+	if err := Unmarshal([]byte(`d1:pli1ee1:vd1:ai1eee`), &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.P == nil || !reflect.DeepEqual(v.P.raw, []string{`li1ee`}) {
+		t.Errorf("nil pointer field: P = %+v", v.P)
+	}
+	if !reflect.DeepEqual(v.V.raw, []string{`d1:ai1ee`}) {
+		t.Errorf("value field: V = %+v", v.V)
+	}
+
+	existing := &countingUnmarshaler{raw: []string{"old"}}
+	v = T{P: existing}
+	if err := Unmarshal([]byte(`d1:p3:newe`), &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.P != existing || !reflect.DeepEqual(existing.raw, []string{"old", "3:new"}) {
+		t.Errorf("non-nil pointer field: P = %p %+v, want %p", v.P, v.P, existing)
+	}
+}
+
+// countdownContext is a context that becomes done after its Err method has
+// been called a number of times.
+type countdownContext struct {
+	context.Context
+	n int
+}
+
+func (c *countdownContext) Err() error {
+	if c.n--; c.n < 0 {
+		return context.DeadlineExceeded
+	}
+	return nil
+}
+
+func TestUnmarshalContext(t *testing.T) {
+	data := []byte("l" + strings.Repeat("0:", 10000) + "e")
+
+	var v []string
+	if err := UnmarshalContext(context.Background(), data, &v); err != nil || len(v) != 10000 {
+		t.Errorf("UnmarshalContext = %d elements, %v", len(v), err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := UnmarshalContext(ctx, data, &v); err != context.Canceled {
+		t.Errorf("UnmarshalContext with canceled context = %v", err)
+	}
+
+	// Validation checks the context once per 64 KiB; let it pass and
+	// expire while decoding.
+	for _, v := range []interface{}{new([]string), new(interface{}), new([]int64)} {
+		in := data
+		if _, ok := v.(*[]int64); ok {
+			in = []byte("l" + strings.Repeat("i0e", 10000) + "e")
+		}
+		if err := UnmarshalContext(&countdownContext{context.Background(), 2}, in, v); err != context.DeadlineExceeded {
+			t.Errorf("UnmarshalContext into %T with expiring context = %v", v, err)
+		}
+	}
+}
+
+func TestUnmarshalMapValues(t *testing.T) {
+	var s struct {
+		Info map[string]int `bencode:"info"`
+	}
+	if err := Unmarshal([]byte(`d4:infod6:lengthi1eee`), &s); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(s.Info, map[string]int{"length": 1}) {
+		t.Errorf("Info = %v", s.Info)
+	}
+
+	type fileInfo struct {
+		Length int64    `bencode:"length"`
+		Path   []string `bencode:"path"`
+	}
+	in := `d1:ad6:lengthi1e4:pathl1:xee1:bd6:lengthi2eee`
+	want := map[string]fileInfo{
+		"a": {Length: 1, Path: []string{"x"}},
+		"b": {Length: 2},
+	}
+
+	var files map[string]fileInfo
+	if err := Unmarshal([]byte(in), &files); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("map[string]fileInfo = %+v, want %+v", files, want)
+	}
+
+	var ptrs map[string]*fileInfo
+	if err := Unmarshal([]byte(in), &ptrs); err != nil {
+		t.Fatal(err)
+	}
+	if len(ptrs) != 2 || ptrs["a"] == ptrs["b"] || !reflect.DeepEqual(*ptrs["a"], want["a"]) || !reflect.DeepEqual(*ptrs["b"], want["b"]) {
+		t.Errorf("map[string]*fileInfo = %+v", ptrs)
+	}
+}
+
+func TestUnmarshalWithSpans(t *testing.T) {
+	var tor Torrent
+	spans, err := UnmarshalWithSpans([]byte(multiFile), &tor)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for path, want := range map[string]string{
+		"announce":          `18:http://tracker/ann`,
+		"announce-list":     `ll18:http://tracker/annel17:udp://tracker/annee`,
+		"info":              multiFileInfo,
+		"info.name":         `3:dir`,
+		"info.private":      `i1e`,
+		"info.files":        `ld6:lengthi1e4:pathl1:aeed6:lengthi2e4:pathl3:dir1:beee`,
+		"info.files.length": `i2e`,
+		"info.files.path":   `l3:dir1:be`,
+	} {
+		span, ok := spans[path]
+		if !ok {
+			t.Errorf("no span for %s", path)
+			continue
+		}
+		if got := multiFile[span[0]:span[1]]; got != want {
+			t.Errorf("span of %s = %#q, want %#q", path, got, want)
+		}
+	}
+	if len(spans) != 10 {
+		t.Errorf("got %d spans, want 10: %v", len(spans), spans)
+	}
+}
+
+func TestUnmarshalNumString(t *testing.T) {
+	type T struct {
+		N   int    `bencode:"n,numstring"`
+		P   *int64 `bencode:"p,numstring"`
+		M   int    `bencode:"m"`
+		Str string `bencode:"s,numstring"`
+	}
+
+	for _, in := range []string{`d1:ni5e1:pi-7e1:s1:xe`, `d1:n1:51:p2:-71:s1:xe`} {
+		var v T
+		if err := Unmarshal([]byte(in), &v); err != nil {
+			t.Errorf("Unmarshal(%#q): %v", in, err)
+			continue
+		}
+		if v.N != 5 || v.P == nil || *v.P != -7 || v.Str != "x" {
+			t.Errorf("Unmarshal(%#q) = %+v", in, v)
+		}
+	}
+
+	var v T
+	for _, in := range []string{`d1:m1:5e`, `d1:n3:fooe`} {
+		if err := Unmarshal([]byte(in), &v); err == nil {
+			t.Errorf("Unmarshal(%#q) succeeded", in)
+		}
+	}
+
+	b, err := Marshal(T{N: 5})
+	if err != nil || string(b) != `d1:mi0e1:ni5e1:s0:e` {
+		t.Errorf("Marshal = %#q, %v", b, err)
+	}
+}
+
+func TestUnmarshalRejectsWhitespace(t *testing.T) {
+	// Bencode has no insignificant whitespace, unlike JSON. Whitespace is
+	// only ever string content, as in the length-2 string of `2: a`.
+	// Trailing bytes after the top-level value are not covered here.
+	for _, in := range []string{
+		` i1e`,
+		"\ni1e",
+		"\ti1e",
+		`i 1e`,
+		`i1 e`,
+		`l i1ee`,
+		`li1e e`,
+		"li1e\ni2ee",
+		`d 1:ai1ee`,
+		`d1:a i1ee`,
+		"d1:a\ti1ee",
+		`d1:ai1e e`,
+		"d1:ai1e\r\n1:bi2ee",
+		`1 :a`,
+		"2\n:ab",
+	} {
+		var v interface{}
+		err := Unmarshal([]byte(in), &v)
+		if _, ok := err.(*SyntaxError); !ok {
+			t.Errorf("Unmarshal(%q) = %v (%T), want *SyntaxError", in, err, err)
+		}
+		if Valid([]byte(in)) {
+			t.Errorf("Valid(%q) = true", in)
+		}
+	}
+}
+
+func TestUnmarshalBool(t *testing.T) {
+	for _, tt := range []struct {
+		data string
+		want bool
+		ok   bool
+	}{
+		{`d7:privatei0ee`, false, true},
+		{`d7:privatei1ee`, true, true},
+		{`d7:privatei2ee`, false, false},
+		{`d7:privatei-1ee`, false, false},
+		{`d7:privatei10ee`, false, false},
+		{`d7:private1:1e`, false, false},
+	} {
+		var v struct {
+			Private bool `bencode:"private"`
+		}
+		err := Unmarshal([]byte(tt.data), &v)
+		if !tt.ok {
+			if _, isType := err.(*UnmarshalTypeError); !isType {
+				t.Errorf("Unmarshal(%#q) = %v, want *UnmarshalTypeError", tt.data, err)
+			}
+			continue
+		}
+		if err != nil || v.Private != tt.want {
+			t.Errorf("Unmarshal(%#q) = %v, %v; want %v", tt.data, v.Private, err, tt.want)
+		}
+	}
+}
+
+func TestNumber(t *testing.T) {
+	for _, tt := range []struct {
+		n   Number
+		i   int64
+		iOK bool
+		u   uint64
+		uOK bool
+	}{
+		{"0", 0, true, 0, true},
+		{"-5", -5, true, 0, false},
+		{"42", 42, true, 42, true},
+		{"9223372036854775807", math.MaxInt64, true, math.MaxInt64, true},
+		{"-9223372036854775808", math.MinInt64, true, 0, false},
+		{"9223372036854775808", 0, false, 1 << 63, true},
+		{"18446744073709551616", 0, false, 0, false},
+		{"-9223372036854775809", 0, false, 0, false},
+	} {
+		i, err := tt.n.Int64()
+		if (err == nil) != tt.iOK || err == nil && i != tt.i {
+			t.Errorf("Number(%q).Int64() = %d, %v", tt.n, i, err)
+		}
+		u, err := tt.n.Uint64()
+		if (err == nil) != tt.uOK || err == nil && u != tt.u {
+			t.Errorf("Number(%q).Uint64() = %d, %v", tt.n, u, err)
+		}
+	}
+
+	dec := NewDecoder(strings.NewReader(`li-5ei0ee`))
+	dec.UseNumber()
+	var v []interface{}
+	if err := dec.Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	if n, ok := v[0].(Number); !ok || n != "-5" {
+		t.Errorf("Decode with UseNumber = %#v", v)
+	}
+}
+
+func TestUnmarshalValue(t *testing.T) {
+	type info struct {
+		Name   string `bencode:"name"`
+		Length int    `bencode:"length"`
+	}
+
+	for _, typ := range []reflect.Type{reflect.TypeOf(info{}), reflect.TypeOf(&info{}), reflect.TypeOf(map[string]interface{}{})} {
+		rv := reflect.New(typ).Elem()
+		if err := UnmarshalValue([]byte(`d6:lengthi3e4:name1:ae`), rv); err != nil {
+			t.Errorf("UnmarshalValue into %v: %v", typ, err)
+			continue
+		}
+		var got info
+		switch v := rv.Interface().(type) {
+		case info:
+			got = v
+		case *info:
+			got = *v
+		case map[string]interface{}:
+			got = info{Name: v["name"].(string), Length: int(v["length"].(int64))}
+		}
+		if got != (info{"a", 3}) {
+			t.Errorf("UnmarshalValue into %v = %#v", typ, rv.Interface())
+		}
+	}
+
+	var n int
+	if err := UnmarshalValue([]byte(`i1e`), reflect.ValueOf(n)); err == nil {
+		t.Error("UnmarshalValue into an unsettable value succeeded")
+	}
+	if err := UnmarshalValue([]byte(`i1e`), reflect.Value{}); err == nil {
+		t.Error("UnmarshalValue into the zero Value succeeded")
+	}
+	if err := UnmarshalValue([]byte(`i1`), reflect.ValueOf(&n).Elem()); err == nil {
+		t.Error("UnmarshalValue of invalid data succeeded")
+	}
+}
+
+func TestUnmarshalTrailingData(t *testing.T) {
+	for _, tt := range []struct {
+		data   string
+		offset int64
+	}{
+		{`i1ei2e`, 3},
+		{`d1:ai1eex`, 8},
+		{`0: `, 2},
+		{`le` + "\n", 2},
+	} {
+		var v interface{}
+		err := Unmarshal([]byte(tt.data), &v)
+		se, ok := err.(*SyntaxError)
+		if !ok || !errors.Is(err, ErrTrailingData) || se.Offset != tt.offset {
+			t.Errorf("Unmarshal(%q) = %v, want ErrTrailingData at offset %d", tt.data, err, tt.offset)
+		}
+		if Valid([]byte(tt.data)) {
+			t.Errorf("Valid(%q) = true", tt.data)
+		}
+	}
+
+	if err := Unmarshal([]byte(`i1x`), new(interface{})); errors.Is(err, ErrTrailingData) {
+		t.Errorf("Unmarshal(`i1x`) = %v, which is not about trailing data", err)
+	}
+
+	// A Decoder reads the same input as a stream of values.
+	dec := NewDecoder(strings.NewReader(`i1ei2e`))
+	for i := 0; i < 2; i++ {
+		var n int
+		if err := dec.Decode(&n); err != nil || n != i+1 {
+			t.Errorf("Decode = %d, %v; want %d", n, err, i+1)
+		}
+	}
+}
+
+func TestBinaryMapKeys(t *testing.T) {
+	const key = "\x00\xff\x80a"
+	data := []byte("d4:" + key + "i1e1:bi2ee")
+
+	var m map[string]int
+	if err := Unmarshal(data, &m); err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 2 || m[key] != 1 || m["b"] != 2 {
+		t.Errorf("Unmarshal = %q", m)
+	}
+
+	b, err := Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Errorf("Marshal = %q, want %q", b, data)
+	}
+
+	// Interned keys keep their bytes too.
+	dec := NewDecoder(bytes.NewReader(data))
+	dec.InternKeys()
+	var im map[string]interface{}
+	if err := dec.Decode(&im); err != nil {
+		t.Fatal(err)
+	}
+	if im[key] != int64(1) {
+		t.Errorf("Decode with InternKeys = %q", im)
+	}
+}
+
+func TestUnmarshalEmptyString(t *testing.T) {
+	var v struct {
+		B  []byte  `bencode:"b"`
+		S  string  `bencode:"s"`
+		P  *string `bencode:"p"`
+		I  interface{}
+		A  [0]byte `bencode:"a"`
+		BP *[]byte `bencode:"bp"`
+	}
+	v.S = "old"
+	if err := Unmarshal([]byte("d1:I0:1:a0:1:b0:2:bp0:1:p0:1:s0:e"), &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.B == nil || len(v.B) != 0 {
+		t.Errorf("B = %#v, want empty non-nil slice", v.B)
+	}
+	if v.S != "" {
+		t.Errorf("S = %q, want empty string", v.S)
+	}
+	if v.P == nil || *v.P != "" {
+		t.Errorf("P = %#v, want pointer to empty string", v.P)
+	}
+	if v.I != "" {
+		t.Errorf("I = %#v, want empty string", v.I)
+	}
+	if v.BP == nil || *v.BP == nil || len(*v.BP) != 0 {
+		t.Errorf("BP = %#v, want pointer to empty non-nil slice", v.BP)
+	}
+}
+
+func TestUnmarshalEmptyStringField(t *testing.T) {
+	var v struct{ Foo string }
+	v.Foo = "old"
+	if err := Unmarshal([]byte("d3:foo0:e"), &v); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if v.Foo != "" {
+		t.Errorf("Foo = %q, want empty string", v.Foo)
+	}
+
+	var m map[string]string
+	if err := Unmarshal([]byte("d3:foo0:e"), &m); err != nil {
+		t.Fatalf("Unmarshal into map: %v", err)
+	}
+	if s, ok := m["foo"]; !ok || s != "" {
+		t.Errorf("m = %q, want foo set to empty string", m)
+	}
+}
+
+func TestUnmarshalIntegerBoundary(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		ptr  interface{}
+		want interface{}
+	}{
+		{"i0e", new(int), 0},
+		{"i7e", new(int8), int8(7)},
+		{"i9e", new(uint), uint(9)},
+		{"i-1e", new(int64), int64(-1)},
+		{"i0e", new(interface{}), int64(0)},
+		{"i5e", new(Number), Number("5")},
+		{"i1e", new(bool), true},
+	} {
+		if err := Unmarshal([]byte(tt.in), tt.ptr); err != nil {
+			t.Errorf("Unmarshal(%q, %T): %v", tt.in, tt.ptr, err)
+			continue
+		}
+		if got := reflect.ValueOf(tt.ptr).Elem().Interface(); got != tt.want {
+			t.Errorf("Unmarshal(%q, %T) = %#v, want %#v", tt.in, tt.ptr, got, tt.want)
+		}
+	}
+
+	// The empty integer is a syntax error, not a ,string tag error.
+	var n int
+	if err := Unmarshal([]byte("ie"), &n); err == nil || strings.Contains(err.Error(), ",string") {
+		t.Errorf("Unmarshal(ie) = %v, want syntax error", err)
+	} else if _, ok := err.(*SyntaxError); !ok {
+		t.Errorf("Unmarshal(ie) = %T, want *SyntaxError", err)
+	}
+
+	// An empty string is not a number even with StringsAsNumbers.
+	dec := NewDecoder(strings.NewReader("0:"))
+	dec.StringsAsNumbers()
+	err := dec.Decode(&n)
+	if _, ok := err.(*UnmarshalTypeError); !ok {
+		t.Errorf("Decode(0:) with StringsAsNumbers = %v, want *UnmarshalTypeError", err)
+	}
+}
+
+func TestUnmarshalListDictThenString(t *testing.T) {
+	const data = `ld0:0:e0:e`
+	want := []interface{}{map[string]interface{}{"": ""}, ""}
+
+	var v []interface{}
+	if err := Unmarshal([]byte(data), &v); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(v, want) {
+		t.Errorf("Unmarshal = %#v, want %#v", v, want)
+	}
+
+	var i interface{}
+	dec := NewDecoder(strings.NewReader(data + data))
+	for n := 0; n < 2; n++ {
+		if err := dec.Decode(&i); err != nil {
+			t.Fatalf("Decode #%d: %v", n, err)
+		}
+		if !reflect.DeepEqual(i, interface{}(want)) {
+			t.Errorf("Decode #%d = %#v, want %#v", n, i, want)
+		}
+	}
+
+	var typed struct {
+		M map[string]string
+		S string
+	}
+	var elems []RawMessage
+	if err := Unmarshal([]byte(data), &elems); err != nil {
+		t.Fatal(err)
+	}
+	if len(elems) != 2 || string(elems[0]) != `d0:0:e` || string(elems[1]) != `0:` {
+		t.Fatalf("Unmarshal into []RawMessage = %q", elems)
+	}
+	if err := Unmarshal(elems[0], &typed.M); err != nil || len(typed.M) != 1 {
+		t.Errorf("Unmarshal(%q) = %q, %v", elems[0], typed.M, err)
+	}
+	typed.S = "old"
+	if err := Unmarshal(elems[1], &typed.S); err != nil || typed.S != "" {
+		t.Errorf("Unmarshal(%q) = %q, %v", elems[1], typed.S, err)
+	}
+}
+
+func TestUnmarshalReuseSlice(t *testing.T) {
+	type peer struct {
+		IP   string `bencode:"ip"`
+		Port int    `bencode:"port"`
+	}
+	s := make([]peer, 0, 4)
+	backing := s[:cap(s)]
+
+	if err := Unmarshal([]byte(`ld2:ip1:a4:porti1eed2:ip1:b4:porti2eed2:ip1:cee`), &s); err != nil {
+		t.Fatal(err)
+	}
+	if len(s) != 3 || &s[0] != &backing[0] {
+		t.Fatalf("Unmarshal = %v, want 3 elements in the original backing array", s)
+	}
+
+	if err := Unmarshal([]byte(`ld2:ip1:xee`), &s); err != nil {
+		t.Fatal(err)
+	}
+	if want := []peer{{IP: "x", Port: 1}}; !reflect.DeepEqual(s, want) || &s[0] != &backing[0] {
+		t.Errorf("Unmarshal = %v, want %v in the original backing array", s, want)
+	}
+	for i, p := range backing[1:] {
+		if p != (peer{}) {
+			t.Errorf("backing[%d] = %v, want cleared", i+1, p)
+		}
+	}
+
+	// Elements beyond the old length start from zero.
+	backing[1] = peer{IP: "stale", Port: 9}
+	if err := Unmarshal([]byte(`ld2:ip1:xed4:porti3eee`), &s); err != nil {
+		t.Fatal(err)
+	}
+	if want := []peer{{IP: "x", Port: 1}, {Port: 3}}; !reflect.DeepEqual(s, want) {
+		t.Errorf("Unmarshal = %v, want %v", s, want)
+	}
+
+	if err := Unmarshal([]byte(`le`), &s); err != nil {
+		t.Fatal(err)
+	}
+	if s == nil || len(s) != 0 || cap(s) != 4 {
+		t.Errorf("Unmarshal(le) = %#v with cap %d, want empty slice of the original backing array", s, cap(s))
+	}
+
+	ints := make([]int, 0, 8)
+	if err := Unmarshal([]byte(`li1ei2ee`), &ints); err != nil {
+		t.Fatal(err)
+	}
+	if err := Unmarshal([]byte(`le`), &ints); err != nil || ints == nil || cap(ints) != 8 {
+		t.Errorf("Unmarshal(le) into []int = %#v with cap %d, %v", ints, cap(ints), err)
+	}
+}
+
+func TestUnmarshalDefault(t *testing.T) {
+	type Embedded struct {
+		Tier int `bencode:"tier,default=1"`
+	}
+	type announce struct {
+		*Embedded
+		Port     int     `bencode:"port,default=6881"`
+		Event    string  `bencode:"event,default=started"`
+		Compact  bool    `bencode:"compact,default=true"`
+		NumWant  *uint16 `bencode:"numwant,default=50"`
+		Left     int64   `bencode:"left"`
+		Key      string  `bencode:"key,omitempty,default=abc"`
+		Optional *string `bencode:"optional"`
+	}
+
+	var v announce
+	if err := Unmarshal([]byte(`d4:lefti5ee`), &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Port != 6881 || v.Event != "started" || !v.Compact || v.NumWant == nil || *v.NumWant != 50 || v.Key != "abc" || v.Left != 5 {
+		t.Errorf("Unmarshal with absent keys = %+v", v)
+	}
+	if v.Embedded == nil || v.Tier != 1 {
+		t.Errorf("Unmarshal with absent keys set embedded Tier = %+v, want 1", v.Embedded)
+	}
+	if v.Optional != nil {
+		t.Errorf("Optional = %q, want nil", *v.Optional)
+	}
+
+	// Present keys win, even when they hold the zero value.
+	v = announce{}
+	if err := Unmarshal([]byte(`d7:compacti0e5:event0:3:key1:x7:numwanti0e4:porti0e4:tieri0ee`), &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Port != 0 || v.Event != "" || v.Compact || v.NumWant == nil || *v.NumWant != 0 || v.Key != "x" || v.Tier != 0 {
+		t.Errorf("Unmarshal with present keys = %+v", v)
+	}
+
+	// Defaults only apply to dictionaries decoded into the struct.
+	var outer struct {
+		A announce   `bencode:"a"`
+		L []announce `bencode:"l"`
+	}
+	if err := Unmarshal([]byte(`d1:lld4:porti1eedeee`), &outer); err != nil {
+		t.Fatal(err)
+	}
+	if outer.A.Port != 0 {
+		t.Errorf("absent struct field A has Port %d, want 0", outer.A.Port)
+	}
+	if len(outer.L) != 2 || outer.L[0].Port != 1 || outer.L[1].Port != 6881 {
+		t.Errorf("list elements = %+v", outer.L)
+	}
+
+	for _, bad := range []interface{}{
+		new(struct {
+			N int `bencode:"n,default=x"`
+		}),
+		new(struct {
+			N int8 `bencode:"n,default=300"`
+		}),
+		new(struct {
+			B bool `bencode:"b,default=maybe"`
+		}),
+		new(struct {
+			L []int `bencode:"l,default=1"`
+		}),
+	} {
+		err := Unmarshal([]byte(`de`), bad)
+		if err == nil || !strings.Contains(err.Error(), "invalid default") {
+			t.Errorf("Unmarshal into %T = %v, want invalid default error", bad, err)
+		}
+	}
+}
@@ -0,0 +1,20 @@
+// Package bencode implements encoding and decoding of bencode, the data
+// format of BitTorrent metainfo files and tracker responses, as described by
+// BEP 3. The mapping between bencode and Go values follows encoding/json and
+// is described in the documentation for the Marshal and Unmarshal functions.
+//
+// Decoding into an empty interface value produces a tree built from exactly
+// these types:
+//
+//	map[string]interface{}, for bencode dictionaries
+//	[]interface{}, for bencode lists
+//	int64, for bencode integers
+//	string, for bencode strings
+//
+// so any valid input, such as a complete torrent file, can be inspected
+// without declaring a struct for it first:
+//
+//	var v interface{}
+//	err := bencode.Unmarshal(data, &v)
+//	info := v.(map[string]interface{})["info"].(map[string]interface{})
+package bencode
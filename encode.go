@@ -1,14 +1,832 @@
 package bencode
 
 import (
+	"bytes"
+	"encoding"
+	"errors"
+	"fmt"
+	"io"
 	"reflect"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"unicode"
 )
 
-type encoderFunc func() // func(e *encodeState, v reflect.Value, opts encOpts)
+// Marshal returns the bencode encoding of v.
+//
+// Booleans and integers encode as bencode integers, strings, byte slices and
+// byte arrays as bencode strings, other slices and arrays as lists, and maps
+// with string keys and structs as dictionaries. A slice of byte arrays, such
+// as the [][20]byte of a torrent's piece hashes, encodes as a single string
+// concatenating all of them. The keys of maps and structs are written in
+// sorted order, as the specification requires. Dictionaries Marshal does not
+// build itself, such as those in a RawMessage, a RawDictionary, the output
+// of a MarshalBencode method or a struct encoded with Encoder.SetFieldOrder,
+// are written as they are; use CanonicalMarshal for output that is canonical
+// throughout.
+//
+// Bencode has no null value: nil pointers and interfaces are omitted when
+// they appear as a struct field or map value and are an error anywhere else.
+// Floating point numbers, channels and functions cannot be encoded.
+//
+// A time.Time encodes as the integer number of seconds since the Unix epoch,
+// or, for a struct field with the "rfc3339" tag option, as in
+// `bencode:"created,rfc3339"`, as a string in RFC 3339 format. Unmarshal
+// accepts either representation for any time.Time and returns times in UTC.
+//
+// Values implementing Marshaler encode as the bencode returned by their
+// MarshalBencode method, and other values implementing
+// encoding.TextMarshaler as the string returned by their MarshalText method.
+//
+// A struct field of struct or pointer to struct type with the "inline" tag
+// option, as in `bencode:",inline"`, has its own fields encoded as keys of
+// the enclosing dictionary, just like the fields of an embedded struct, and
+// Unmarshal decodes them from there in turn. Unlike with embedding, a key
+// defined by an inlined field and by any other field is an error.
+//
+// A field of type RawMessage or *RawMessage with the "raw" tag option, as in
+// `bencode:",raw"`, is never encoded. Unmarshal sets it to the complete
+// encoding of the dictionary its struct was decoded from.
+//
+// A []byte field with the "bytelist" tag option encodes as a list of
+// integers, one per byte, instead of as a string. Unmarshal accepts either
+// form for any []byte.
+//
+// A numeric field with the "numstring" tag option, as in
+// `bencode:"n,numstring"`, is still encoded as an integer, but Unmarshal
+// also accepts a string holding a decimal integer for it, as a Decoder does
+// for every field after StringsAsNumbers.
+//
+// An integer, string or bool field, or a pointer to one, with the "default"
+// tag option, as in `bencode:"port,default=6881"`, is encoded as usual, but
+// Unmarshal sets it to the given value when the dictionary its struct is
+// decoded from has no key for it. A bool default is written as for
+// strconv.ParseBool, and a string default cannot contain a comma.
+func Marshal(v interface{}) ([]byte, error) {
+	return MarshalAppend(nil, v)
+}
+
+// CanonicalMarshal is like Marshal but also sorts the keys of the
+// dictionaries Marshal writes as they are, such as those in a RawMessage, so
+// that the whole output is canonical, as computing an info-hash requires. A
+// dictionary with a duplicate key cannot be made canonical and is reported by
+// a CanonicalError. Decoding canonical bencode into an interface{} and
+// encoding the result with CanonicalMarshal reproduces the input byte for
+// byte.
+func CanonicalMarshal(v interface{}) ([]byte, error) {
+	b, err := Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return SortKeys(b)
+}
+
+// MarshalAppend appends the bencode encoding of v to dst and returns the
+// extended buffer, like strconv.AppendInt. Reusing dst across calls avoids
+// allocating a new slice for every value. If encoding fails, dst is returned
+// unchanged along with the error.
+func MarshalAppend(dst []byte, v interface{}) ([]byte, error) {
+	e := newEncodeState()
+
+	err := e.marshal(v, encOpts{})
+	if err != nil {
+		return dst, err
+	}
+	dst = append(dst, e.Bytes()...)
+
+	encodeStatePool.Put(e)
+
+	return dst, nil
+}
+
+// MarshalSize returns the length of the encoding of v that Marshal would
+// return, without building it, for instance to set the Content-Length of a
+// response before writing it with an Encoder. It walks v exactly like
+// Marshal does and fails where Marshal would. The results of MarshalBencode
+// methods are still allocated by those methods.
+func MarshalSize(v interface{}) (int, error) {
+	e := &encodeState{sizeOnly: true}
+	if err := e.marshal(v, encOpts{}); err != nil {
+		return 0, err
+	}
+	return e.size, nil
+}
+
+type Marshaler interface {
+	MarshalBencode() ([]byte, error)
+}
+
+type UnsupportedTypeError struct {
+	Type reflect.Type
+}
+
+func (e *UnsupportedTypeError) Error() string {
+	return "bencode: unsupported type: " + e.Type.String()
+}
+
+type UnsupportedValueError struct {
+	Value reflect.Value
+	Str   string
+}
+
+func (e *UnsupportedValueError) Error() string {
+	return "bencode: unsupported value: " + e.Str
+}
+
+type MarshalerError struct {
+	Type reflect.Type
+	Err  error
+}
+
+func (e *MarshalerError) Error() string {
+	return "bencode: error calling MarshalBencode for type " + e.Type.String() + ": " + e.Err.Error()
+}
+
+func (e *MarshalerError) Unwrap() error { return e.Err }
+
+type encodeState struct {
+	bytes.Buffer
+	scratch [64]byte
+
+	// sizeOnly makes the encodeState count the bytes written to it in
+	// size instead of buffering them, for MarshalSize.
+	sizeOnly bool
+	size     int
+
+	// w, if not nil, is the writer the encoding is destined for. A
+	// StringReader flushes the buffer to w and copies its contents there
+	// directly, setting streamed.
+	w        io.Writer
+	streamed bool
+}
+
+func (e *encodeState) Write(p []byte) (int, error) {
+	if e.sizeOnly {
+		e.size += len(p)
+		return len(p), nil
+	}
+	return e.Buffer.Write(p)
+}
+
+func (e *encodeState) WriteString(s string) (int, error) {
+	if e.sizeOnly {
+		e.size += len(s)
+		return len(s), nil
+	}
+	return e.Buffer.WriteString(s)
+}
+
+func (e *encodeState) WriteByte(c byte) error {
+	if e.sizeOnly {
+		e.size++
+		return nil
+	}
+	return e.Buffer.WriteByte(c)
+}
+
+var encodeStatePool sync.Pool
+
+func newEncodeState() *encodeState {
+	if v := encodeStatePool.Get(); v != nil {
+		e := v.(*encodeState)
+		e.Reset()
+		e.w, e.streamed = nil, false
+		return e
+	}
+	return new(encodeState)
+}
+
+// bencodeError is an error wrapper type for internal use only.
+// Panics with errors are wrapped in bencodeError so that the top-level
+// recover can distinguish intentional panics from this package.
+type bencodeError struct{ error }
+
+func (e *encodeState) marshal(v interface{}, opts encOpts) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if be, ok := r.(bencodeError); ok {
+				err = be.error
+			} else {
+				panic(r)
+			}
+		}
+	}()
+	e.reflectValue(reflect.ValueOf(v), opts)
+	return nil
+}
+
+func (e *encodeState) error(err error) {
+	panic(bencodeError{err})
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
+// isNilValue reports whether v has no bencode representation and must be
+// left out of the enclosing dictionary.
+func isNilValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return !v.IsValid()
+}
+
+func (e *encodeState) reflectValue(v reflect.Value, opts encOpts) {
+	valueEncoder(v)(e, v, opts)
+}
+
+type encOpts struct {
+	// keyMapper, if not nil, turns the Go name of a struct field without
+	// a name in its tag into its dictionary key.
+	keyMapper func(goFieldName string) string
+
+	// useStringer makes types implementing fmt.Stringer or error encode
+	// as strings.
+	useStringer bool
+
+	// fieldOrder maps struct types to the position in their encoding of
+	// the keys that do not come in sorted order.
+	fieldOrder map[reflect.Type]map[string]int
+
+	// structFields, if not nil, caches the fields of struct types as
+	// renamed by keyMapper and ordered by fieldOrder. The Encoder replaces
+	// it whenever either of them changes.
+	structFields map[reflect.Type][]field
+}
+
+type encoderFunc func(e *encodeState, v reflect.Value, opts encOpts)
+
+var encoderCache sync.Map
+
+func valueEncoder(v reflect.Value) encoderFunc {
+	if !v.IsValid() {
+		return invalidValueEncoder
+	}
+	return typeEncoder(v.Type())
+}
+
+func typeEncoder(t reflect.Type) encoderFunc {
+	if fi, ok := encoderCache.Load(t); ok {
+		return fi.(encoderFunc)
+	}
+
+	// To deal with recursive types, populate the map with an
+	// indirect func before we build it. This type waits on the
+	// real func (f) to be ready and then calls it. This indirect
+	// func is only used for recursive types.
+	var (
+		wg sync.WaitGroup
+		f  encoderFunc
+	)
+	wg.Add(1)
+	fi, loaded := encoderCache.LoadOrStore(t, encoderFunc(func(e *encodeState, v reflect.Value, opts encOpts) {
+		wg.Wait()
+		f(e, v, opts)
+	}))
+	if loaded {
+		return fi.(encoderFunc)
+	}
+
+	f = newTypeEncoder(t, true)
+	wg.Done()
+	encoderCache.Store(t, f)
+	return f
+}
+
+var (
+	marshalerType     = reflect.TypeOf((*Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	stringerType      = reflect.TypeOf((*fmt.Stringer)(nil)).Elem()
+	errorType         = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// implementsStringer reports whether t can be encoded as a string by
+// stringerEncoder.
+func implementsStringer(t reflect.Type) bool {
+	return t.Implements(stringerType) || t.Implements(errorType)
+}
+
+func newTypeEncoder(t reflect.Type, allowAddr bool) encoderFunc {
+	if t.Kind() != reflect.Ptr && allowAddr && reflect.PtrTo(t).Implements(marshalerType) {
+		return newCondAddrEncoder(addrMarshalerEncoder, newTypeEncoder(t, false))
+	}
+	if t.Implements(marshalerType) {
+		return marshalerEncoder
+	}
+	if t == timeType {
+		return timeEncoder
+	}
+	if t == numberType {
+		return numberEncoder
+	}
+	if t == stringReaderType {
+		return stringReaderEncoder
+	}
+	if t.Kind() != reflect.Ptr && allowAddr && reflect.PtrTo(t).Implements(textMarshalerType) {
+		return newCondAddrEncoder(addrTextMarshalerEncoder, newTypeEncoder(t, false))
+	}
+	if t.Implements(textMarshalerType) {
+		return textMarshalerEncoder
+	}
+	if allowAddr && (implementsStringer(t) || t.Kind() != reflect.Ptr && implementsStringer(reflect.PtrTo(t))) {
+		se := stringerEncoder{addr: !implementsStringer(t), elseEnc: newTypeEncoder(t, false)}
+		return se.encode
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return boolEncoder
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return intEncoder
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return uintEncoder
+	case reflect.String:
+		return stringEncoder
+	case reflect.Interface:
+		return interfaceEncoder
+	case reflect.Struct:
+		return newStructEncoder(t)
+	case reflect.Map:
+		return newMapEncoder(t)
+	case reflect.Slice:
+		return newSliceEncoder(t)
+	case reflect.Array:
+		return newArrayEncoder(t)
+	case reflect.Ptr:
+		return newPtrEncoder(t)
+	default:
+		return unsupportedTypeEncoder
+	}
+}
+
+func invalidValueEncoder(e *encodeState, v reflect.Value, _ encOpts) {
+	e.error(&UnsupportedValueError{v, "nil"})
+}
+
+func marshalerEncoder(e *encodeState, v reflect.Value, _ encOpts) {
+	if v.Kind() == reflect.Ptr && v.IsNil() {
+		e.error(&UnsupportedValueError{v, "nil " + v.Type().String()})
+	}
+	m, ok := v.Interface().(Marshaler)
+	if !ok {
+		e.error(&UnsupportedValueError{v, "nil " + v.Type().String()})
+	}
+	e.writeMarshaler(v, m)
+}
+
+func addrMarshalerEncoder(e *encodeState, v reflect.Value, _ encOpts) {
+	va := v.Addr()
+	e.writeMarshaler(v, va.Interface().(Marshaler))
+}
+
+func (e *encodeState) writeMarshaler(v reflect.Value, m Marshaler) {
+	b, err := m.MarshalBencode()
+	if err == nil {
+		err = checkValid(b, &scanner{})
+	}
+	if err != nil {
+		e.error(&MarshalerError{v.Type(), err})
+	}
+	e.Write(b)
+}
+
+func textMarshalerEncoder(e *encodeState, v reflect.Value, _ encOpts) {
+	if v.Kind() == reflect.Ptr && v.IsNil() {
+		e.error(&UnsupportedValueError{v, "nil " + v.Type().String()})
+	}
+	e.writeTextMarshaler(v, v.Interface().(encoding.TextMarshaler))
+}
+
+func addrTextMarshalerEncoder(e *encodeState, v reflect.Value, _ encOpts) {
+	e.writeTextMarshaler(v, v.Addr().Interface().(encoding.TextMarshaler))
+}
+
+func (e *encodeState) writeTextMarshaler(v reflect.Value, m encoding.TextMarshaler) {
+	b, err := m.MarshalText()
+	if err != nil {
+		e.error(&MarshalerError{v.Type(), err})
+	}
+	e.stringBytes(b)
+}
+
+// stringerEncoder encodes a value as the string returned by its String or
+// Error method, in that order of preference, if the useStringer option is
+// set, and with elseEnc otherwise. If addr is set, the methods are
+// those of the pointer to the value, which is only used if it is addressable.
+type stringerEncoder struct {
+	addr    bool
+	elseEnc encoderFunc
+}
+
+func (se stringerEncoder) encode(e *encodeState, v reflect.Value, opts encOpts) {
+	if !opts.useStringer || (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && v.IsNil() || se.addr && !v.CanAddr() {
+		se.elseEnc(e, v, opts)
+		return
+	}
+	if se.addr {
+		v = v.Addr()
+	}
+	switch s := v.Interface().(type) {
+	case fmt.Stringer:
+		e.string(s.String())
+	case error:
+		e.string(s.Error())
+	}
+}
+
+func boolEncoder(e *encodeState, v reflect.Value, _ encOpts) {
+	if v.Bool() {
+		e.WriteString("i1e")
+	} else {
+		e.WriteString("i0e")
+	}
+}
+
+func intEncoder(e *encodeState, v reflect.Value, _ encOpts) {
+	b := append(e.scratch[:0], 'i')
+	b = strconv.AppendInt(b, v.Int(), 10)
+	e.Write(append(b, 'e'))
+}
+
+func uintEncoder(e *encodeState, v reflect.Value, _ encOpts) {
+	b := append(e.scratch[:0], 'i')
+	b = strconv.AppendUint(b, v.Uint(), 10)
+	e.Write(append(b, 'e'))
+}
+
+// numberEncoder encodes a Number as the integer it holds, not as a string,
+// so that a value decoded with UseNumber is encoded as it was read. The empty
+// Number is encoded as i0e.
+func numberEncoder(e *encodeState, v reflect.Value, _ encOpts) {
+	n := v.String()
+	if n == "" {
+		n = "0"
+	}
+	if !isCanonicalInt(n) {
+		e.error(fmt.Errorf("bencode: invalid number literal %q", n))
+	}
+	e.WriteByte('i')
+	e.WriteString(n)
+	e.WriteByte('e')
+}
+
+// isCanonicalInt reports whether s is the text of a bencode integer: an
+// optionally negative decimal without leading zeros, and not -0.
+func isCanonicalInt(s string) bool {
+	if s != "" && s[0] == '-' {
+		s = s[1:]
+		if s == "0" {
+			return false
+		}
+	}
+	if s == "" || s[0] == '0' && len(s) > 1 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// StringReader is encoded as a bencode string of length N whose contents are
+// read from R, for instance to write a torrent's pieces field as its pieces
+// are hashed instead of building the whole string first. An Encoder or
+// StreamEncoder copies the contents from R to its writer directly; Marshal
+// still reads them into the returned slice, and MarshalSize does not read R
+// at all. Exactly N bytes are read; it is an error for R to end before that.
+type StringReader struct {
+	R io.Reader `bencode:"-"`
+	N int64     `bencode:"-"`
+}
+
+var stringReaderType = reflect.TypeOf(StringReader{})
+
+func stringReaderEncoder(e *encodeState, v reflect.Value, _ encOpts) {
+	sr := v.Interface().(StringReader)
+	if sr.R == nil {
+		e.error(errors.New("bencode: StringReader with nil Reader"))
+	}
+	if sr.N < 0 {
+		e.error(fmt.Errorf("bencode: StringReader with negative length %d", sr.N))
+	}
+	e.Write(strconv.AppendInt(e.scratch[:0], sr.N, 10))
+	e.WriteByte(':')
+	if e.sizeOnly {
+		e.size += int(sr.N)
+		return
+	}
+
+	w := io.Writer(&e.Buffer)
+	if e.w != nil {
+		if _, err := e.w.Write(e.Bytes()); err != nil {
+			e.error(err)
+		}
+		e.Reset()
+		e.streamed = true
+		w = e.w
+	}
+	n, err := io.CopyN(w, sr.R, sr.N)
+	if err == io.EOF {
+		err = fmt.Errorf("bencode: StringReader ended after %d of %d bytes", n, sr.N)
+	}
+	if err != nil {
+		e.error(err)
+	}
+}
+
+func stringEncoder(e *encodeState, v reflect.Value, _ encOpts) {
+	e.string(v.String())
+}
+
+func (e *encodeState) string(s string) {
+	e.Write(strconv.AppendInt(e.scratch[:0], int64(len(s)), 10))
+	e.WriteByte(':')
+	e.WriteString(s)
+}
+
+func (e *encodeState) stringBytes(s []byte) {
+	e.Write(strconv.AppendInt(e.scratch[:0], int64(len(s)), 10))
+	e.WriteByte(':')
+	e.Write(s)
+}
+
+func interfaceEncoder(e *encodeState, v reflect.Value, opts encOpts) {
+	if v.IsNil() {
+		e.error(&UnsupportedValueError{v, "nil " + v.Type().String()})
+	}
+	e.reflectValue(v.Elem(), opts)
+}
+
+func unsupportedTypeEncoder(e *encodeState, v reflect.Value, _ encOpts) {
+	e.error(&UnsupportedTypeError{v.Type()})
+}
+
+type structEncoder struct {
+	typ    reflect.Type
+	fields []field
+}
+
+func (se structEncoder) encode(e *encodeState, v reflect.Value, opts encOpts) {
+	fields := se.fields
+	if opts.structFields != nil {
+		fields = se.optionFields(e, opts)
+	}
+
+	e.WriteByte('d')
+FieldLoop:
+	for i := range fields {
+		f := &fields[i]
+
+		// Find the nested struct field by following f.index.
+		fv := v
+		for _, i := range f.index {
+			if fv.Kind() == reflect.Ptr {
+				if fv.IsNil() {
+					continue FieldLoop
+				}
+				fv = fv.Elem()
+			}
+			fv = fv.Field(i)
+		}
+
+		if f.raw || f.omitEmpty && isEmptyValue(fv) || isNilValue(fv) {
+			continue
+		}
+		e.WriteString(f.nameEncoded)
+		f.encoder(e, fv, opts)
+	}
+	e.WriteByte('e')
+}
+
+// optionFields returns the fields of se as renamed by the keyMapper and
+// ordered by the fieldOrder of opts, computing them only once per struct
+// type and Encoder.
+func (se structEncoder) optionFields(e *encodeState, opts encOpts) []field {
+	if fields, ok := opts.structFields[se.typ]; ok {
+		return fields
+	}
+	fields := se.fields
+	if opts.keyMapper != nil {
+		fields = se.mapKeys(e, opts.keyMapper)
+	}
+	if order, ok := opts.fieldOrder[se.typ]; ok {
+		fields = orderFields(fields, order)
+	}
+	opts.structFields[se.typ] = fields
+	return fields
+}
+
+// mapKeys returns the fields of se renamed by fn and sorted by their new
+// names. Fields named by their tag keep their names.
+func (se structEncoder) mapKeys(e *encodeState, fn func(string) string) []field {
+	fields := append([]field(nil), se.fields...)
+	for i := range fields {
+		f := &fields[i]
+		if f.tag {
+			continue
+		}
+		f.name = fn(f.name)
+		f.nameEncoded = strconv.Itoa(len(f.name)) + ":" + f.name
+	}
+	sort.Slice(fields, func(i, j int) bool {
+		return fields[i].name < fields[j].name
+	})
+	for i := 1; i < len(fields); i++ {
+		if fields[i].name == fields[i-1].name {
+			e.error(fmt.Errorf("bencode: key %q is produced by more than one field of %v", fields[i].name, se.typ))
+		}
+	}
+	return fields
+}
+
+// orderFields returns a copy of fields with the fields whose names are in
+// order first, by their positions in it, followed by the others in their
+// original order.
+func orderFields(fields []field, order map[string]int) []field {
+	fields = append([]field(nil), fields...)
+	rank := func(f *field) int {
+		if i, ok := order[f.name]; ok {
+			return i
+		}
+		return len(order)
+	}
+	sort.SliceStable(fields, func(i, j int) bool {
+		return rank(&fields[i]) < rank(&fields[j])
+	})
+	return fields
+}
+
+func newStructEncoder(t reflect.Type) encoderFunc {
+	list, err := cachedTypeFields(t)
+	if err != nil {
+		return func(e *encodeState, _ reflect.Value, _ encOpts) {
+			e.error(err)
+		}
+	}
+	fields := append([]field(nil), list...)
+	sort.Slice(fields, func(i, j int) bool {
+		return fields[i].name < fields[j].name
+	})
+	se := structEncoder{typ: t, fields: fields}
+	return se.encode
+}
+
+type mapEncoder struct {
+	elemEnc encoderFunc
+}
+
+func (me mapEncoder) encode(e *encodeState, v reflect.Value, opts encOpts) {
+	keys := v.MapKeys()
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].String() < keys[j].String()
+	})
+
+	e.WriteByte('d')
+	for _, k := range keys {
+		mv := v.MapIndex(k)
+		if isNilValue(mv) {
+			continue
+		}
+		e.string(k.String())
+		me.elemEnc(e, mv, opts)
+	}
+	e.WriteByte('e')
+}
+
+func newMapEncoder(t reflect.Type) encoderFunc {
+	if t.Key().Kind() != reflect.String {
+		return unsupportedTypeEncoder
+	}
+	me := mapEncoder{typeEncoder(t.Elem())}
+	return me.encode
+}
+
+func encodeByteSlice(e *encodeState, v reflect.Value, _ encOpts) {
+	e.stringBytes(v.Bytes())
+}
+
+func encodeByteArray(e *encodeState, v reflect.Value, _ encOpts) {
+	b := make([]byte, v.Len())
+	reflect.Copy(reflect.ValueOf(b), v)
+	e.stringBytes(b)
+}
+
+func newSliceEncoder(t reflect.Type) encoderFunc {
+	// Byte slices get special treatment; byte arrays get theirs in
+	// newArrayEncoder.
+	if t.Elem().Kind() == reflect.Uint8 {
+		p := reflect.PtrTo(t.Elem())
+		if !p.Implements(marshalerType) {
+			return encodeByteSlice
+		}
+	}
+	// So do slices of byte arrays, such as the [][20]byte of piece hashes.
+	if isByteArray(t.Elem()) {
+		return encodeByteArraySlice
+	}
+	return newArrayEncoder(t)
+}
+
+// isByteArray reports whether t is an array of bytes that encodes as a
+// string.
+func isByteArray(t reflect.Type) bool {
+	return t.Kind() == reflect.Array && t.Elem().Kind() == reflect.Uint8 && !reflect.PtrTo(t.Elem()).Implements(marshalerType) && !t.Implements(marshalerType) && !reflect.PtrTo(t).Implements(marshalerType)
+}
+
+// encodeByteArraySlice encodes a slice of byte arrays as a single string
+// holding all of them back to back.
+func encodeByteArraySlice(e *encodeState, v reflect.Value, _ encOpts) {
+	n := v.Type().Elem().Len()
+	b := make([]byte, v.Len()*n)
+	for i := 0; i < v.Len(); i++ {
+		reflect.Copy(reflect.ValueOf(b[i*n:(i+1)*n]), v.Index(i))
+	}
+	e.stringBytes(b)
+}
+
+type arrayEncoder struct {
+	elemEnc encoderFunc
+}
+
+func (ae arrayEncoder) encode(e *encodeState, v reflect.Value, opts encOpts) {
+	e.WriteByte('l')
+	n := v.Len()
+	for i := 0; i < n; i++ {
+		ae.elemEnc(e, v.Index(i), opts)
+	}
+	e.WriteByte('e')
+}
+
+func newArrayEncoder(t reflect.Type) encoderFunc {
+	if isByteArray(t) {
+		return encodeByteArray
+	}
+	enc := arrayEncoder{typeEncoder(t.Elem())}
+	return enc.encode
+}
+
+type ptrEncoder struct {
+	elemEnc encoderFunc
+}
+
+func (pe ptrEncoder) encode(e *encodeState, v reflect.Value, opts encOpts) {
+	if v.IsNil() {
+		e.error(&UnsupportedValueError{v, "nil " + v.Type().String()})
+	}
+	pe.elemEnc(e, v.Elem(), opts)
+}
+
+func newPtrEncoder(t reflect.Type) encoderFunc {
+	enc := ptrEncoder{typeEncoder(t.Elem())}
+	return enc.encode
+}
+
+type condAddrEncoder struct {
+	canAddrEnc, elseEnc encoderFunc
+}
+
+func (ce condAddrEncoder) encode(e *encodeState, v reflect.Value, opts encOpts) {
+	if v.CanAddr() {
+		ce.canAddrEnc(e, v, opts)
+	} else {
+		ce.elseEnc(e, v, opts)
+	}
+}
+
+// newCondAddrEncoder returns an encoder that checks whether its value
+// CanAddr and delegates to canAddrEnc if so, else to elseEnc.
+func newCondAddrEncoder(canAddrEnc, elseEnc encoderFunc) encoderFunc {
+	enc := condAddrEncoder{canAddrEnc: canAddrEnc, elseEnc: elseEnc}
+	return enc.encode
+}
+
+func typeByIndex(t reflect.Type, index []int) reflect.Type {
+	for _, i := range index {
+		if t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		t = t.Field(i).Type
+	}
+	return t
+}
 
 func isValidTag(s string) bool {
 	if s == "" {
@@ -29,13 +847,23 @@ type field struct {
 	nameBytes []byte
 	equalFold func(s, t []byte) bool
 
-	nameNonEsc string
+	nameEncoded string
 
 	tag       bool
 	index     []int
 	typ       reflect.Type
 	omitEmpty bool
 	quoted    bool
+	required  bool
+	inline    bool
+	raw       bool
+	rfc3339   bool
+	bytelist  bool
+	numString bool
+
+	// defaultValue, if valid, is the value of the "default" tag option,
+	// of type typ.
+	defaultValue reflect.Value
 
 	encoder encoderFunc
 }
@@ -58,7 +886,7 @@ func (x byIndex) Less(i, j int) bool {
 	return len(x[i].index) < len(x[j].index)
 }
 
-func typeFields(t reflect.Type) []field {
+func typeFields(t reflect.Type) ([]field, error) {
 	current := []field{}
 	next := []field{{typ: t}}
 
@@ -113,7 +941,9 @@ func typeFields(t reflect.Type) []field {
 				quoted := false
 				//if opts.Contains("string") {}
 
-				if name != "" || !sf.Anonymous || ft.Kind() != reflect.Struct {
+				inline := opts.Contains("inline") && ft.Kind() == reflect.Struct
+
+				if !inline && (name != "" || !sf.Anonymous || ft.Kind() != reflect.Struct) {
 					tagged := name != ""
 					if name == "" {
 						name = sf.Name
@@ -125,10 +955,23 @@ func typeFields(t reflect.Type) []field {
 						typ:       ft,
 						omitEmpty: opts.Contains("omitempty"),
 						quoted:    quoted,
+						required:  opts.Contains("required"),
+						inline:    f.inline,
+						raw:       opts.Contains("raw") && ft == rawMessageType,
+						rfc3339:   opts.Contains("rfc3339") && ft == timeType,
+						bytelist:  opts.Contains("bytelist") && sf.Type.Kind() == reflect.Slice && sf.Type.Elem().Kind() == reflect.Uint8 && !sf.Type.Implements(marshalerType),
+						numString: opts.Contains("numstring") && isNumberKind(ft.Kind()),
+					}
+					if def, ok := opts.Value("default"); ok {
+						dv, ok := parseDefault(def, ft)
+						if !ok {
+							return nil, fmt.Errorf("bencode: invalid default %q for field %s of Go struct %v", def, sf.Name, t)
+						}
+						field.defaultValue = dv
 					}
 					field.nameBytes = []byte(field.name)
 					field.equalFold = foldFunc(field.nameBytes)
-					field.nameNonEsc = `"` + field.name + `":`
+					field.nameEncoded = strconv.Itoa(len(field.name)) + ":" + field.name
 
 					fields = append(fields, field)
 					if count[f.typ] > 1 {
@@ -139,7 +982,7 @@ func typeFields(t reflect.Type) []field {
 
 				nextCount[ft]++
 				if nextCount[ft] == 1 {
-					next = append(next, field{name: ft.Name(), index: index, typ: ft})
+					next = append(next, field{name: ft.Name(), index: index, typ: ft, inline: f.inline || inline})
 				}
 			}
 		}
@@ -173,6 +1016,11 @@ func typeFields(t reflect.Type) []field {
 			out = append(out, fi)
 			continue
 		}
+		for _, fj := range fields[i : i+advance] {
+			if fj.inline {
+				return nil, fmt.Errorf("bencode: key %q of Go struct %v is defined by more than one field", name, t)
+			}
+		}
 		dominant, ok := dominantField(fields[i : i+advance])
 		if ok {
 			out = append(out, dominant)
@@ -184,9 +1032,15 @@ func typeFields(t reflect.Type) []field {
 
 	for i := range fields {
 		f := &fields[i]
-		f.encoder = func() {}
+		f.encoder = typeEncoder(typeByIndex(t, f.index))
+		if f.rfc3339 {
+			f.encoder = rfc3339Encoder
+		}
+		if f.bytelist {
+			f.encoder = newArrayEncoder(f.typ)
+		}
 	}
-	return fields
+	return fields, nil
 }
 
 func dominantField(fields []field) (field, bool) {
@@ -196,12 +1050,53 @@ func dominantField(fields []field) (field, bool) {
 	return fields[0], true
 }
 
+type structFields struct {
+	list []field
+	err  error
+}
+
 var fieldCache sync.Map
 
-func cachedTypeFields(t reflect.Type) []field {
+// parseDefault parses s, the value of a "default" tag option, as a value of
+// type t, which must be an integer, string or bool type.
+func parseDefault(s string, t reflect.Type) (reflect.Value, bool) {
+	v := reflect.New(t).Elem()
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, t.Bits())
+		if err != nil {
+			return v, false
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, err := strconv.ParseUint(s, 10, t.Bits())
+		if err != nil {
+			return v, false
+		}
+		v.SetUint(n)
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return v, false
+		}
+		v.SetBool(b)
+	default:
+		return v, false
+	}
+	return v, true
+}
+
+// cachedTypeFields is like typeFields but uses a cache to avoid repeated work.
+func cachedTypeFields(t reflect.Type) ([]field, error) {
 	if f, ok := fieldCache.Load(t); ok {
-		return f.([]field)
+		sf := f.(structFields)
+		return sf.list, sf.err
 	}
-	f, _ := fieldCache.LoadOrStore(t, typeFields(t))
-	return f.([]field)
+	var sf structFields
+	sf.list, sf.err = typeFields(t)
+	f, _ := fieldCache.LoadOrStore(t, sf)
+	sf = f.(structFields)
+	return sf.list, sf.err
 }
@@ -0,0 +1,456 @@
+package bencode
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMarshalRoundTripValid(t *testing.T) {
+	for _, tt := range validTests {
+		if !tt.ok {
+			continue
+		}
+		var v interface{}
+		if err := Unmarshal([]byte(tt.data), &v); err != nil {
+			t.Errorf("Unmarshal(%#q): %v", tt.data, err)
+			continue
+		}
+		b, err := CanonicalMarshal(v)
+		if err != nil {
+			t.Errorf("CanonicalMarshal(%#v): %v", v, err)
+			continue
+		}
+		if !bytes.Equal(b, []byte(tt.data)) {
+			t.Errorf("round trip of %#q = %#q", tt.data, b)
+		}
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	type embedded struct {
+		Z int
+	}
+	type value struct {
+		embedded
+		B     bool   `bencode:"b"`
+		Bytes []byte `bencode:"bytes"`
+		List  []int  `bencode:"list"`
+		Empty string `bencode:"empty,omitempty"`
+		Nil   *int   `bencode:"nil"`
+		A     string `bencode:"a"`
+	}
+
+	tests := []struct {
+		v    interface{}
+		want string
+	}{
+		{0, `i0e`},
+		{-42, `i-42e`},
+		{uint64(1 << 63), `i9223372036854775808e`},
+		{true, `i1e`},
+		{"", `0:`},
+		{"foo", `3:foo`},
+		{[]byte("bar"), `3:bar`},
+		{[]string{"a", "b"}, `l1:a1:be`},
+		{[]interface{}(nil), `le`},
+		{map[string]int{"b": 2, "a": 1}, `d1:ai1e1:bi2ee`},
+		{map[string]*int{"nil": nil}, `de`},
+		{value{embedded{7}, true, []byte{0, 1}, []int{1}, "", nil, "x"}, `d1:Zi7e1:a1:x1:bi1e5:bytes2:` + "\x00\x01" + `4:listli1eee`},
+	}
+	for _, tt := range tests {
+		b, err := Marshal(tt.v)
+		if err != nil {
+			t.Errorf("Marshal(%#v): %v", tt.v, err)
+			continue
+		}
+		if string(b) != tt.want {
+			t.Errorf("Marshal(%#v) = %#q, want %#q", tt.v, b, tt.want)
+		}
+	}
+}
+
+func TestMarshalUnsupported(t *testing.T) {
+	for _, v := range []interface{}{
+		nil,
+		1.5,
+		(*int)(nil),
+		[]interface{}{nil},
+		map[int]string{1: "a"},
+		make(chan int),
+	} {
+		if b, err := Marshal(v); err == nil {
+			t.Errorf("Marshal(%#v) = %#q, want error", v, b)
+		}
+	}
+}
+
+func TestMarshalOrderedMap(t *testing.T) {
+	m := OrderedMap{
+		{"name", "foo"},
+		{"length", 3},
+		{"missing", nil},
+		{"files", OrderedMap{{"z", 1}, {"a", 2}}},
+	}
+	b, err := Marshal(struct {
+		Info OrderedMap `bencode:"info"`
+	}{m})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `d4:infod5:filesd1:ai2e1:zi1ee6:lengthi3e4:name3:fooee`; string(b) != want {
+		t.Errorf("Marshal = %#q, want %#q", b, want)
+	}
+	if m[0].Key != "name" {
+		t.Error("MarshalBencode reordered its receiver")
+	}
+
+	if _, err := Marshal(OrderedMap{{"a", 1}, {"a", 2}}); err == nil {
+		t.Error("Marshal accepted duplicate keys")
+	}
+}
+
+func TestMarshalIntegerWidths(t *testing.T) {
+	for _, tt := range integerWidthTests {
+		if tt.typ.Size() < 8 && (tt.typ.Kind() == reflect.Int || tt.typ.Kind() == reflect.Uint || tt.typ.Kind() == reflect.Uintptr) {
+			continue
+		}
+		for _, s := range []string{tt.min, tt.max} {
+			want := "i" + s + "e"
+			v := reflect.New(tt.typ)
+			if err := Unmarshal([]byte(want), v.Interface()); err != nil {
+				t.Errorf("Unmarshal(%s) into %v: %v", want, tt.typ, err)
+				continue
+			}
+			b, err := Marshal(v.Elem().Interface())
+			if err != nil {
+				t.Errorf("Marshal(%v(%s)): %v", tt.typ, s, err)
+				continue
+			}
+			if string(b) != want {
+				t.Errorf("Marshal(%v(%s)) = %s, want %s", tt.typ, s, b, want)
+			}
+		}
+	}
+
+	var v struct {
+		N uint32 `bencode:"n"`
+	}
+	if err := Unmarshal([]byte(`d1:ni4294967295ee`), &v); err != nil || v.N != 4294967295 {
+		t.Errorf("Unmarshal of max uint32 = %d, %v", v.N, err)
+	}
+	if b, _ := Marshal(v); string(b) != `d1:ni4294967295ee` {
+		t.Errorf("Marshal of max uint32 = %s", b)
+	}
+}
+
+func TestRawDictionaryRoundTrip(t *testing.T) {
+	for _, in := range []string{
+		`d8:announce3:foo4:infod4:name3:bar6:lengthi1eee`,
+		`d4:infod6:lengthi1e4:name3:bare8:announce3:fooe`,
+		`de`,
+	} {
+		var d RawDictionary
+		if err := Unmarshal([]byte(in), &d); err != nil {
+			t.Errorf("Unmarshal(%#q): %v", in, err)
+			continue
+		}
+		b, err := Marshal(d)
+		if err != nil {
+			t.Errorf("Marshal(%#q): %v", in, err)
+			continue
+		}
+		if string(b) != in {
+			t.Errorf("round trip of %#q = %#q", in, b)
+		}
+	}
+
+	var d RawDictionary
+	if err := Unmarshal([]byte(`d4:infoi1e8:announce3:fooe`), &d); err != nil {
+		t.Fatal(err)
+	}
+	d[1].Value = RawMessage(`3:bar`)
+	if b, err := Marshal(d); err != nil || string(b) != `d4:infoi1e8:announce3:bare` {
+		t.Errorf("Marshal after edit = %#q, %v", b, err)
+	}
+}
+
+type inlineCommon struct {
+	Comment string `bencode:"comment,omitempty"`
+	Length  int    `bencode:"length"`
+}
+
+type inlineOuter struct {
+	Name   string        `bencode:"name"`
+	Common inlineCommon  `bencode:",inline"`
+	Extra  *inlineCommon `bencode:"extra,omitempty"`
+}
+
+type inlineCollision struct {
+	Length int          `bencode:"length"`
+	Common inlineCommon `bencode:",inline"`
+}
+
+func TestInline(t *testing.T) {
+	in := inlineOuter{Name: "a", Common: inlineCommon{Comment: "c", Length: 3}}
+	const want = `d7:comment1:c6:lengthi3e4:name1:ae`
+
+	b, err := Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != want {
+		t.Errorf("Marshal = %#q, want %#q", b, want)
+	}
+
+	var out inlineOuter
+	if err := Unmarshal([]byte(want), &out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("Unmarshal = %+v, want %+v", out, in)
+	}
+
+	if _, err := Marshal(inlineCollision{}); err == nil {
+		t.Error("Marshal succeeded with colliding inline field")
+	}
+	var c inlineCollision
+	if err := Unmarshal([]byte(`d6:lengthi1ee`), &c); err == nil {
+		t.Error("Unmarshal succeeded with colliding inline field")
+	}
+}
+
+func TestTimeRoundTrip(t *testing.T) {
+	type times struct {
+		Created  time.Time  `bencode:"created"`
+		Modified time.Time  `bencode:"modified,rfc3339"`
+		Expires  *time.Time `bencode:"expires,rfc3339"`
+		Deleted  *time.Time `bencode:"deleted,rfc3339"`
+	}
+
+	created := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	modified := time.Date(2021, 6, 7, 8, 9, 10, 500, time.UTC)
+	expires := modified.Add(time.Hour)
+	in := times{Created: created, Modified: modified, Expires: &expires}
+	const want = `d7:createdi1577934245e7:expires28:2021-06-07T09:09:10.0000005Z8:modified28:2021-06-07T08:09:10.0000005Ze`
+
+	b, err := Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != want {
+		t.Errorf("Marshal = %#q, want %#q", b, want)
+	}
+
+	var out times
+	if err := Unmarshal(b, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !out.Created.Equal(created) || !out.Modified.Equal(modified) || out.Expires == nil || !out.Expires.Equal(expires) || out.Deleted != nil {
+		t.Errorf("Unmarshal = %+v, want %+v", out, in)
+	}
+
+	var bad times
+	if err := Unmarshal([]byte(`d8:modified9:yesterdaye`), &bad); err == nil {
+		t.Error("Unmarshal accepted a malformed time")
+	}
+}
+
+func TestByteList(t *testing.T) {
+	type T struct {
+		List   []byte `bencode:"list,bytelist"`
+		String []byte `bencode:"string"`
+	}
+
+	in := T{List: []byte{0, 1, 255}, String: []byte{0, 1, 255}}
+	const want = "d4:listli0ei1ei255ee6:string3:\x00\x01\xffe"
+	b, err := Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != want {
+		t.Errorf("Marshal = %q, want %q", b, want)
+	}
+
+	var out T
+	if err := Unmarshal(b, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("Unmarshal = %v, want %v", out, in)
+	}
+
+	if err := Unmarshal([]byte(`d4:listli256eee`), &out); err == nil {
+		t.Error("Unmarshal accepted 256 in a byte list")
+	}
+}
+
+func TestMarshalNestedMaps(t *testing.T) {
+	v := map[string]map[string]map[string]int{
+		"z": {"b": {"y": 1, "x": 2}, "a": {"c": 3}},
+		"a": {"z": {"b": 4, "a": 5}, "m": {}},
+	}
+	const want = `d1:ad1:mde1:zd1:ai5e1:bi4eee1:zd1:ad1:ci3ee1:bd1:xi2e1:yi1eeee`
+
+	b, err := Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != want {
+		t.Errorf("Marshal = %#q, want %#q", b, want)
+	}
+	if err := CheckCanonical(b); err != nil {
+		t.Error(err)
+	}
+
+	deep := []interface{}{map[string]interface{}{
+		"b": []interface{}{map[string]interface{}{"z": 1, "a": []interface{}{map[string]int{"q": 1, "p": 2}}}},
+		"a": map[string][]map[string]int{"y": {{"d": 1, "c": 2}}},
+	}}
+	b, err = Marshal(deep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckCanonical(b); err != nil {
+		t.Errorf("Marshal of nested lists and maps = %#q: %v", b, err)
+	}
+}
+
+func TestMarshalAppend(t *testing.T) {
+	buf := []byte("l")
+	buf, err := MarshalAppend(buf, map[string]int{"a": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err = MarshalAppend(buf, "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(buf)+"e", `ld1:ai1ee1:xe`; got != want {
+		t.Errorf("MarshalAppend = %#q, want %#q", got, want)
+	}
+
+	got, err := MarshalAppend(buf, make(chan int))
+	if err == nil || string(got) != string(buf) {
+		t.Errorf("MarshalAppend(chan) = %#q, %v; want %#q and an error", got, err, buf)
+	}
+}
+
+func TestMarshalRawMessageMap(t *testing.T) {
+	var m map[string]RawMessage
+	if err := Unmarshal([]byte(multiFile), &m); err != nil {
+		t.Fatal(err)
+	}
+	original := make(map[string]string)
+	for k, v := range m {
+		original[k] = string(v)
+	}
+
+	announce, err := Marshal("udp://new/ann")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m["announce"] = announce
+	m["comment"] = RawMessage(`4:note`)
+
+	b, err := Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckCanonical(b); err != nil {
+		t.Errorf("Marshal = %#q: %v", b, err)
+	}
+
+	var got map[string]RawMessage
+	if err := Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got["announce"]) != `13:udp://new/ann` || string(got["comment"]) != `4:note` {
+		t.Errorf("edited values = %#q, %#q", got["announce"], got["comment"])
+	}
+	for _, k := range []string{"announce-list", "info"} {
+		if string(got[k]) != original[k] {
+			t.Errorf("value of %q = %#q, want %#q", k, got[k], original[k])
+		}
+	}
+
+	m["comment"] = RawMessage(`4:not`)
+	if _, err := Marshal(m); err == nil {
+		t.Error("Marshal accepted an invalid RawMessage")
+	}
+}
+
+func TestMarshalSize(t *testing.T) {
+	type file struct {
+		Length  int64    `bencode:"length"`
+		Path    []string `bencode:"path"`
+		Comment string   `bencode:"comment,omitempty"`
+	}
+	var tor Torrent
+	if err := Unmarshal([]byte(multiFile), &tor); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, v := range []interface{}{
+		0,
+		-1234567,
+		uint64(1 << 63),
+		"",
+		strings.Repeat("x", 1000),
+		[]byte("abc"),
+		[2][3]byte{},
+		true,
+		[]interface{}{1, "a", []int{}},
+		map[string]interface{}{"b": 1, "a": []int{1, 2}, "c": nil},
+		file{Length: 10, Path: []string{"a", "b"}},
+		&file{Length: 10, Path: []string{"a"}, Comment: "note"},
+		time.Unix(1600000000, 0),
+		RawMessage(`d1:ai1ee`),
+		OrderedMap{{"b", 1}, {"a", 2}},
+		tor,
+	} {
+		b, err := Marshal(v)
+		if err != nil {
+			t.Fatalf("Marshal(%#v): %v", v, err)
+		}
+		n, err := MarshalSize(v)
+		if err != nil || n != len(b) {
+			t.Errorf("MarshalSize(%#v) = %d, %v; want %d", v, n, err, len(b))
+		}
+	}
+
+	if _, err := MarshalSize(make(chan int)); err == nil {
+		t.Error("MarshalSize(chan) succeeded")
+	}
+}
+
+func TestMarshalNumber(t *testing.T) {
+	for _, tt := range []struct {
+		in   interface{}
+		want string
+	}{
+		{map[string]interface{}{"n": Number("42")}, "d1:ni42ee"},
+		{map[string]interface{}{"n": "42"}, "d1:n2:42e"},
+		{[]Number{"-7", "0", ""}, "li-7ei0ei0ee"},
+		{struct {
+			N *Number `bencode:"n"`
+		}{new(Number)}, "d1:ni0ee"},
+	} {
+		b, err := Marshal(tt.in)
+		if err != nil {
+			t.Errorf("Marshal(%#v): %v", tt.in, err)
+			continue
+		}
+		if string(b) != tt.want {
+			t.Errorf("Marshal(%#v) = %q, want %q", tt.in, b, tt.want)
+		}
+	}
+
+	for _, n := range []Number{"x", "1.5", "01", "-0", "-", " 1"} {
+		if b, err := Marshal(n); err == nil {
+			t.Errorf("Marshal(Number(%q)) = %q, want error", n, b)
+		}
+	}
+}
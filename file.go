@@ -0,0 +1,58 @@
+package bencode
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// DecodeFile decodes the first bencode value in the named file, such as a
+// .torrent file, into the value pointed to by v. The file is closed before
+// DecodeFile returns, whether or not decoding succeeded.
+func DecodeFile(path string, v interface{}) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return NewDecoder(f).Decode(v)
+}
+
+// EncodeFile writes the canonical bencode encoding of v to the named file.
+// The encoding is written to a temporary file in the same directory, which
+// is then renamed over path, so readers see either the previous contents or
+// the complete new file and never a partial one. A new file is created with
+// permission 0644.
+func EncodeFile(path string, v interface{}) error {
+	b, err := Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(tmp)
+		}
+	}()
+
+	if _, err = f.Write(b); err != nil {
+		return err
+	}
+	if err = f.Chmod(0644); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,72 @@
+package bencode
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDecodeFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bencode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "test.torrent")
+	if err := ioutil.WriteFile(path, []byte(singleFile), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var tor Torrent
+	if err := DecodeFile(path, &tor); err != nil {
+		t.Fatal(err)
+	}
+	if tor.Announce != "http://tracker/ann" || tor.Info.Name != "file.bin" {
+		t.Errorf("DecodeFile = %+v", tor)
+	}
+
+	if err := DecodeFile(filepath.Join(dir, "missing.torrent"), &tor); !os.IsNotExist(err) {
+		t.Errorf("DecodeFile of a missing file = %v", err)
+	}
+}
+
+func TestEncodeFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bencode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "test.torrent")
+	if err := ioutil.WriteFile(path, []byte("old contents"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	want, err := ParseTorrent([]byte(singleFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := EncodeFile(path, want); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != singleFile {
+		t.Errorf("EncodeFile wrote %#q, want %#q", b, singleFile)
+	}
+
+	if err := EncodeFile(path, make(chan int)); err == nil {
+		t.Error("EncodeFile of an unsupported value succeeded")
+	}
+	if b, _ := ioutil.ReadFile(path); string(b) != singleFile {
+		t.Error("failed EncodeFile changed the existing file")
+	}
+	if names, _ := filepath.Glob(filepath.Join(dir, ".*")); len(names) != 0 {
+		t.Errorf("EncodeFile left temporary files %q", names)
+	}
+}
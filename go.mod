@@ -1,3 +1,3 @@
 module code.witches.io/go/bencode
 
-go 1.13
+go 1.18
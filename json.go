@@ -0,0 +1,129 @@
+package bencode
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"unicode/utf8"
+)
+
+// FromJSON converts a single JSON value to canonical bencode.
+//
+// Objects become dictionaries, arrays become lists, strings become bencode
+// strings and booleans become the integers 0 and 1. Numbers must be integers
+// written without a fraction or exponent; they are converted exactly,
+// whatever their size. The conversion is lossy in two ways: there is no
+// bencode representation for a fractional number or for null, so FromJSON
+// returns an error if it finds either, and booleans decode back as integers.
+func FromJSON(jsonData []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(jsonData))
+	dec.UseNumber()
+
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("bencode: FromJSON: trailing data after JSON value")
+	}
+
+	v, err := fromJSONValue(v)
+	if err != nil {
+		return nil, err
+	}
+	return Marshal(v)
+}
+
+func fromJSONValue(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case nil:
+		return nil, errors.New("bencode: FromJSON: cannot convert null")
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	case json.Number:
+		n, ok := new(big.Int).SetString(string(v), 10)
+		if !ok {
+			return nil, errors.New("bencode: FromJSON: cannot convert non-integer number " + string(v))
+		}
+		return RawMessage("i" + n.String() + "e"), nil
+	case string:
+		return v, nil
+	case []interface{}:
+		for i, e := range v {
+			e, err := fromJSONValue(e)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = e
+		}
+		return v, nil
+	case map[string]interface{}:
+		for k, e := range v {
+			e, err := fromJSONValue(e)
+			if err != nil {
+				return nil, err
+			}
+			v[k] = e
+		}
+		return v, nil
+	}
+	panic("bencode: unexpected JSON value")
+}
+
+// ToJSON converts a single bencode value to JSON for inspection.
+//
+// Dictionaries become objects, lists become arrays and integers become
+// numbers, except that integers outside the range a float64 represents
+// exactly (±2^53) become JSON strings holding their decimal text. Strings
+// that are valid UTF-8 become JSON strings. Any other string, such as the
+// SHA-1 hashes in a torrent's pieces, becomes an object with the single key
+// "$base64" whose value is the string's standard base64 encoding. Dictionary
+// keys that are not valid UTF-8 have their invalid bytes replaced by U+FFFD.
+func ToJSON(bencodeData []byte) ([]byte, error) {
+	var d decodeState
+	if err := checkValid(bencodeData, &d.scan); err != nil {
+		return nil, err
+	}
+	d.init(bencodeData)
+	d.useNumber = true
+
+	var v interface{}
+	if err := d.unmarshal(&v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(toJSONValue(v))
+}
+
+const maxExactJSONInteger = 1 << 53
+
+func toJSONValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case Number:
+		if n, err := v.Int64(); err == nil && -maxExactJSONInteger <= n && n <= maxExactJSONInteger {
+			return json.Number(v)
+		}
+		return string(v)
+	case string:
+		if utf8.ValidString(v) {
+			return v
+		}
+		return map[string]string{"$base64": base64.StdEncoding.EncodeToString([]byte(v))}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = toJSONValue(e)
+		}
+		return v
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = toJSONValue(e)
+		}
+		return v
+	}
+	panic("bencode: unexpected decoded value")
+}
@@ -0,0 +1,74 @@
+package bencode
+
+import (
+	"testing"
+)
+
+func TestFromJSON(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{`0`, `i0e`},
+		{`-0`, `i0e`},
+		{`-42`, `i-42e`},
+		{`123456789012345678901234567890`, `i123456789012345678901234567890e`},
+		{`true`, `i1e`},
+		{`false`, `i0e`},
+		{`"foo"`, `3:foo`},
+		{`"é"`, "2:é"},
+		{`[]`, `le`},
+		{`{}`, `de`},
+		{`{"b": [1, "x"], "a": {"c": true}}`, `d1:ad1:ci1ee1:bli1e1:xee`},
+	}
+	for _, tt := range tests {
+		b, err := FromJSON([]byte(tt.in))
+		if err != nil {
+			t.Errorf("FromJSON(%#q): %v", tt.in, err)
+			continue
+		}
+		if string(b) != tt.want {
+			t.Errorf("FromJSON(%#q) = %#q, want %#q", tt.in, b, tt.want)
+		}
+	}
+}
+
+func TestFromJSONLossy(t *testing.T) {
+	for _, in := range []string{`null`, `1.5`, `1.0`, `1e3`, `[null]`, `{"a": 0.1}`, `1 2`, `{`} {
+		if b, err := FromJSON([]byte(in)); err == nil {
+			t.Errorf("FromJSON(%#q) = %#q, want error", in, b)
+		}
+	}
+}
+
+func TestToJSON(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{`i0e`, `0`},
+		{`i-42e`, `-42`},
+		{`i9007199254740992e`, `9007199254740992`},
+		{`i9007199254740993e`, `"9007199254740993"`},
+		{`i-123456789012345678901234567890e`, `"-123456789012345678901234567890"`},
+		{`3:foo`, `"foo"`},
+		{"2:\xff\x00", `{"$base64":"/wA="}`},
+		{`le`, `[]`},
+		{`de`, `{}`},
+		{`d1:bli1e1:xe1:ad1:ci1eee`, `{"a":{"c":1},"b":[1,"x"]}`},
+	}
+	for _, tt := range tests {
+		b, err := ToJSON([]byte(tt.in))
+		if err != nil {
+			t.Errorf("ToJSON(%#q): %v", tt.in, err)
+			continue
+		}
+		if string(b) != tt.want {
+			t.Errorf("ToJSON(%#q) = %#q, want %#q", tt.in, b, tt.want)
+		}
+	}
+
+	if _, err := ToJSON([]byte(`d1:a`)); err == nil {
+		t.Error("ToJSON accepted truncated input")
+	}
+}
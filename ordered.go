@@ -0,0 +1,100 @@
+package bencode
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+)
+
+// KV is a single key/value pair of an OrderedMap.
+type KV struct {
+	Key   string
+	Value interface{}
+}
+
+// OrderedMap is a dictionary built from a slice of key/value pairs rather
+// than a Go map, so it can be constructed and inspected in a deterministic
+// order.
+//
+// Decoding a dictionary into an OrderedMap stores its pairs in the order
+// they appear in the input. Each value is decoded as it would be into an
+// interface{}, so nested dictionaries become map[string]interface{} values;
+// use an OrderedMap field or element type to preserve their order too.
+type OrderedMap []KV
+
+var orderedMapType = reflect.TypeOf(OrderedMap(nil))
+
+// MarshalBencode encodes m as a dictionary. Like every dictionary written by
+// this package its keys are sorted, whatever their order in m, so the output
+// is canonical. Pairs with a nil Value are omitted, and duplicate keys are
+// an error.
+func (m OrderedMap) MarshalBencode() ([]byte, error) {
+	kvs := append(OrderedMap(nil), m...)
+	sort.SliceStable(kvs, func(i, j int) bool {
+		return kvs[i].Key < kvs[j].Key
+	})
+
+	e := newEncodeState()
+	e.WriteByte('d')
+	for i, kv := range kvs {
+		if i > 0 && kvs[i-1].Key == kv.Key {
+			return nil, errors.New("bencode: duplicate key " + kv.Key + " in OrderedMap")
+		}
+		if isNilValue(reflect.ValueOf(kv.Value)) {
+			continue
+		}
+		e.string(kv.Key)
+		if err := e.marshal(kv.Value, encOpts{}); err != nil {
+			return nil, err
+		}
+	}
+	e.WriteByte('e')
+	buf := append([]byte(nil), e.Bytes()...)
+
+	encodeStatePool.Put(e)
+
+	return buf, nil
+}
+
+var _ Marshaler = OrderedMap(nil)
+
+// RawKV is a single key/value pair of a RawDictionary.
+type RawKV struct {
+	Key   string
+	Value RawMessage
+}
+
+// RawDictionary is a dictionary whose values are kept encoded and whose
+// pairs stay in the order they appear in the input. Unlike every other
+// dictionary type, it also encodes its pairs in slice order rather than
+// sorting them, so a decoded dictionary can be edited and written back byte
+// for byte, even if it was not canonical to begin with.
+type RawDictionary []RawKV
+
+var rawDictionaryType = reflect.TypeOf(RawDictionary(nil))
+
+// MarshalBencode encodes m as a dictionary with its pairs in slice order.
+func (m RawDictionary) MarshalBencode() ([]byte, error) {
+	e := newEncodeState()
+	e.WriteByte('d')
+	for _, kv := range m {
+		e.string(kv.Key)
+		if err := e.marshal(kv.Value, encOpts{}); err != nil {
+			return nil, err
+		}
+	}
+	e.WriteByte('e')
+	buf := append([]byte(nil), e.Bytes()...)
+
+	encodeStatePool.Put(e)
+
+	return buf, nil
+}
+
+var _ Marshaler = RawDictionary(nil)
+
+// isPairSlice reports whether t is one of the slice types of key/value
+// pairs that dictionaries can be decoded into.
+func isPairSlice(t reflect.Type) bool {
+	return t == orderedMapType || t == rawDictionaryType
+}
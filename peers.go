@@ -0,0 +1,70 @@
+package bencode
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"strconv"
+)
+
+// ParseCompactPeers parses the compact peers string of a tracker response,
+// as described by BEP 23: a concatenation of 6-byte entries, each an IPv4
+// address followed by a port in network byte order. It returns an error if
+// len(b) is not a multiple of 6.
+func ParseCompactPeers(b []byte) ([]netip.AddrPort, error) {
+	return parseCompactPeers(b, 4)
+}
+
+// ParseCompactPeers6 is like ParseCompactPeers for the peers6 string of BEP 7,
+// whose 18-byte entries each hold an IPv6 address and a port.
+func ParseCompactPeers6(b []byte) ([]netip.AddrPort, error) {
+	return parseCompactPeers(b, 16)
+}
+
+func parseCompactPeers(b []byte, addrLen int) ([]netip.AddrPort, error) {
+	size := addrLen + 2
+	if len(b)%size != 0 {
+		return nil, errors.New("bencode: compact peers length " + strconv.Itoa(len(b)) + " is not a multiple of " + strconv.Itoa(size))
+	}
+	peers := make([]netip.AddrPort, len(b)/size)
+	for i := range peers {
+		entry := b[i*size : (i+1)*size]
+		addr, _ := netip.AddrFromSlice(entry[:addrLen])
+		peers[i] = netip.AddrPortFrom(addr, binary.BigEndian.Uint16(entry[addrLen:]))
+	}
+	return peers, nil
+}
+
+// CompactPeers returns the compact peers string holding peers, the inverse
+// of ParseCompactPeers. It returns an error if any peer is not an IPv4
+// address; IPv4-mapped IPv6 addresses are accepted and stored as IPv4.
+func CompactPeers(peers []netip.AddrPort) ([]byte, error) {
+	b := make([]byte, 0, len(peers)*6)
+	for _, p := range peers {
+		addr := p.Addr().Unmap()
+		if !addr.Is4() {
+			return nil, errors.New("bencode: compact peer " + p.String() + " is not an IPv4 address")
+		}
+		a := addr.As4()
+		b = append(b, a[:]...)
+		b = append(b, byte(p.Port()>>8), byte(p.Port()))
+	}
+	return b, nil
+}
+
+// CompactPeers6 returns the compact peers6 string holding peers, the
+// inverse of ParseCompactPeers6. It returns an error if any peer is not an
+// IPv6 address.
+func CompactPeers6(peers []netip.AddrPort) ([]byte, error) {
+	b := make([]byte, 0, len(peers)*18)
+	for _, p := range peers {
+		addr := p.Addr()
+		if !addr.Is6() || addr.Is4In6() {
+			return nil, errors.New("bencode: compact peer " + p.String() + " is not an IPv6 address")
+		}
+		a := addr.As16()
+		b = append(b, a[:]...)
+		b = append(b, byte(p.Port()>>8), byte(p.Port()))
+	}
+	return b, nil
+}
@@ -0,0 +1,77 @@
+package bencode
+
+import (
+	"net"
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func TestCompactPeers(t *testing.T) {
+	var resp struct {
+		Peers  []byte `bencode:"peers"`
+		Peers6 []byte `bencode:"peers6"`
+	}
+	in := "d5:peers12:\x7f\x00\x00\x01\x1a\xe1\x0a\x00\x00\x02\x00\x506:peers618:\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\xc8\xd5e"
+	if err := Unmarshal([]byte(in), &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	peers, err := ParseCompactPeers(resp.Peers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []netip.AddrPort{netip.MustParseAddrPort("127.0.0.1:6881"), netip.MustParseAddrPort("10.0.0.2:80")}
+	if !reflect.DeepEqual(peers, want) {
+		t.Errorf("ParseCompactPeers = %v, want %v", peers, want)
+	}
+	if b, err := CompactPeers(peers); err != nil || string(b) != string(resp.Peers) {
+		t.Errorf("CompactPeers = %q, %v, want %q", b, err, resp.Peers)
+	}
+
+	peers6, err := ParseCompactPeers6(resp.Peers6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want6 := []netip.AddrPort{netip.MustParseAddrPort("[2001:db8::1]:51413")}
+	if !reflect.DeepEqual(peers6, want6) {
+		t.Errorf("ParseCompactPeers6 = %v, want %v", peers6, want6)
+	}
+	if b, err := CompactPeers6(peers6); err != nil || string(b) != string(resp.Peers6) {
+		t.Errorf("CompactPeers6 = %q, %v, want %q", b, err, resp.Peers6)
+	}
+
+	if _, err := ParseCompactPeers(make([]byte, 7)); err == nil {
+		t.Error("ParseCompactPeers accepted 7 bytes")
+	}
+	if _, err := ParseCompactPeers6(make([]byte, 6)); err == nil {
+		t.Error("ParseCompactPeers6 accepted 6 bytes")
+	}
+	if _, err := CompactPeers(want6); err == nil {
+		t.Error("CompactPeers accepted an IPv6 peer")
+	}
+	if _, err := CompactPeers6(want); err == nil {
+		t.Error("CompactPeers6 accepted an IPv4 peer")
+	}
+	if b, err := CompactPeers([]netip.AddrPort{netip.MustParseAddrPort("[::ffff:127.0.0.1]:6881")}); err != nil || string(b) != "\x7f\x00\x00\x01\x1a\xe1" {
+		t.Errorf("CompactPeers of IPv4-mapped address = %q, %v", b, err)
+	}
+}
+
+func TestUnmarshalIPText(t *testing.T) {
+	var v struct {
+		IP    netip.Addr `bencode:"ip"`
+		NetIP net.IP     `bencode:"netip"`
+		V6    netip.Addr `bencode:"v6"`
+	}
+	if err := Unmarshal([]byte(`d2:ip9:127.0.0.15:netip8:10.0.0.12:v611:2001:db8::1e`), &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.IP != netip.MustParseAddr("127.0.0.1") || !v.NetIP.Equal(net.IPv4(10, 0, 0, 1)) || v.V6 != netip.MustParseAddr("2001:db8::1") {
+		t.Errorf("Unmarshal = %+v", v)
+	}
+
+	if err := Unmarshal([]byte(`d2:ip7:1.2.3.xe`), &v); err == nil {
+		t.Error("Unmarshal accepted an invalid address")
+	}
+}
@@ -1,9 +1,19 @@
 package bencode
 
 import (
+	"context"
+	"errors"
 	"strconv"
 )
 
+// ErrTrailingData is wrapped by the SyntaxError returned when data holding a
+// single value, such as that passed to Unmarshal, continues after the end of
+// the value. Check for it with errors.Is; the offset of the trailing data is
+// the Offset of the SyntaxError.
+var ErrTrailingData = errors.New("bencode: trailing data after top-level value")
+
+// Valid reports whether data is a single valid bencode value, with nothing
+// after it.
 func Valid(data []byte) bool {
 	return checkValid(data, &scanner{}) == nil
 }
@@ -12,11 +22,11 @@ func checkValid(data []byte, scan *scanner) error {
 	scan.reset()
 	for _, c := range data {
 		scan.bytes++
-		//s := scan.step(scan, c)
-		//fmt.Println(scanToken(s))
-		//if s == scanError {
-		if scan.step(scan, c) == scanError {
+		switch scan.step(scan, c) {
+		case scanError:
 			return scan.err
+		case scanEnd:
+			return trailingDataError(scan.bytes - 1)
 		}
 	}
 	if scan.eof() == scanError {
@@ -25,13 +35,121 @@ func checkValid(data []byte, scan *scanner) error {
 	return nil
 }
 
+// checkValidContext is like checkValid but returns ctx.Err() once ctx is
+// done, checking it every 64 KiB of input.
+func checkValidContext(ctx context.Context, data []byte, scan *scanner) error {
+	const chunk = 64 << 10
+	scan.reset()
+	for i, c := range data {
+		if i%chunk == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		scan.bytes++
+		switch scan.step(scan, c) {
+		case scanError:
+			return scan.err
+		case scanEnd:
+			return trailingDataError(scan.bytes - 1)
+		}
+	}
+	if scan.eof() == scanError {
+		return scan.err
+	}
+	return nil
+}
+
+// A Scanner checks bencode input one byte at a time, for validators that
+// need to drive the scan from their own loop. A Scanner can be reused for any
+// number of values by calling Reset between them.
+type Scanner struct {
+	scan scanner
+}
+
+// A TokenType classifies a byte passed to Scanner.Step.
+type TokenType int
+
+const (
+	TokenContinue        TokenType = scanContinue        // a byte within the current token
+	TokenBeginDictionary TokenType = scanBeginDictionary // the d starting a dictionary
+	TokenEndDictionary   TokenType = scanEndDictionary   // the e ending a dictionary
+	TokenBeginList       TokenType = scanBeginList       // the l starting a list
+	TokenEndList         TokenType = scanEndList         // the e ending a list
+	TokenBeginInteger    TokenType = scanBeginInteger    // the i starting an integer
+	TokenInteger         TokenType = scanInteger         // the first byte of an integer's digits
+	TokenEndInteger      TokenType = scanEndInteger      // the e ending an integer
+	TokenBeginString     TokenType = scanBeginString     // the first digit of a string's length
+	TokenString          TokenType = scanString          // the first byte of a string's contents
+	TokenEnd             TokenType = scanEnd             // a byte after the end of the top-level value
+	TokenError           TokenType = scanError           // a syntax error, reported by Err
+)
+
+// NewScanner returns a Scanner ready to scan a value.
+func NewScanner() *Scanner {
+	s := new(Scanner)
+	s.scan.reset()
+	return s
+}
+
+// Reset prepares s to scan a new value, discarding any previous state.
+func (s *Scanner) Reset() {
+	s.scan.reset()
+	s.scan.bytes = 0
+}
+
+// Step scans the next byte of input. Once it has returned TokenError, it
+// keeps doing so until Reset is called.
+func (s *Scanner) Step(c byte) TokenType {
+	s.scan.bytes++
+	return TokenType(s.scan.step(&s.scan, c))
+}
+
+// Done reports whether a complete top-level value has been scanned.
+func (s *Scanner) Done() bool {
+	return s.scan.endTop && s.scan.err == nil
+}
+
+// Err returns the SyntaxError that made Step return TokenError, or nil.
+func (s *Scanner) Err() error {
+	return s.scan.err
+}
+
+// End reports the end of input. It returns nil if a complete top-level
+// value has been scanned and a SyntaxError otherwise.
+func (s *Scanner) End() error {
+	if s.scan.eof() == scanError {
+		return s.scan.err
+	}
+	return nil
+}
+
+// A SyntaxError is a description of a bencode syntax error.
 type SyntaxError struct {
-	msg    string
-	Offset int64
+	msg    string // description of error
+	Offset int64  // error occurred after reading Offset bytes
+
+	// Context says what the scanner was doing when it found the error,
+	// such as "looking for value", "looking for integer" or "end of
+	// input", so that errors can be classified without parsing the
+	// message. It is one of a fixed set of phrases.
+	Context string
+
+	err error // wrapped error, if any
 }
 
 func (e *SyntaxError) Error() string { return e.msg }
 
+// Unwrap returns ErrTrailingData for a SyntaxError about trailing data, and
+// nil otherwise.
+func (e *SyntaxError) Unwrap() error { return e.err }
+
+// trailingDataError returns the SyntaxError for data after the top-level
+// value, starting at offset.
+func trailingDataError(offset int64) error {
+	return &SyntaxError{msg: "trailing data after top-level value", Offset: offset, Context: "after top-level value", err: ErrTrailingData}
+}
+
 const (
 	scanContinue = iota
 
@@ -78,6 +196,17 @@ type scanner struct {
 	string uint64
 
 	digits []byte
+
+	// maxString is the longest string length the scanner accepts, or zero
+	// for no limit.
+	maxString uint64
+
+	// intStart is the offset of the integer being scanned and intDigits the
+	// number of its digits so far. maxIntDigits is the most digits the
+	// scanner accepts in an integer, or zero for no limit.
+	intStart     int64
+	intDigits    int
+	maxIntDigits int
 }
 
 func (s *scanner) reset() {
@@ -86,11 +215,12 @@ func (s *scanner) reset() {
 	s.err = nil
 	s.endTop = false
 	s.digits = s.digits[0:0]
+	s.string = 0
 }
 
 func (s *scanner) error(c byte, context string) int {
 	s.step = stateError
-	s.err = &SyntaxError{"invalid character " + quoteChar(c) + " " + context, s.bytes}
+	s.err = &SyntaxError{msg: "invalid character " + quoteChar(c) + " " + context, Offset: s.bytes, Context: context}
 	return scanError
 }
 
@@ -117,7 +247,7 @@ func (s *scanner) eof() int {
 		return scanEnd
 	}
 	if s.err == nil {
-		s.err = &SyntaxError{"unexpected end of Bencode input", s.bytes}
+		s.err = &SyntaxError{msg: "unexpected end of Bencode input", Offset: s.bytes, Context: "end of input"}
 	}
 	return scanError
 }
@@ -154,6 +284,8 @@ func sv(s *scanner, c byte) int {
 	case 'i':
 		s.step = si
 		s.pushParseState(parseInteger)
+		s.intStart = s.bytes - 1
+		s.intDigits = 0
 		return scanBeginInteger
 	case '0':
 		s.step = ssl0
@@ -187,9 +319,28 @@ func sd(s *scanner, c byte) int {
 		s.digits = append(s.digits, c)
 		return scanBeginString
 	}
+	if kind, ok := nonStringKinds[c]; ok {
+		return s.keyError(kind)
+	}
 	return s.error(c, "looking for string length")
 }
 
+// nonStringKinds names the values that start with a byte other than a digit.
+var nonStringKinds = map[byte]string{
+	'd': "a dictionary",
+	'l': "a list",
+	'i': "an integer",
+}
+
+// keyError reports a value of the given kind where a dictionary key should
+// be, at the offset the value starts.
+func (s *scanner) keyError(kind string) int {
+	offset := s.bytes - 1
+	s.step = stateError
+	s.err = &SyntaxError{msg: "dictionary key at offset " + strconv.FormatInt(offset, 10) + " is " + kind + ", but dictionary keys must be strings", Offset: offset, Context: "dictionary key not a string"}
+	return scanError
+}
+
 func ssl0(s *scanner, c byte) int {
 	if c == ':' {
 		return ssle(s, c)
@@ -210,11 +361,20 @@ func ssl(s *scanner, c byte) int {
 
 func ssle(s *scanner, c byte) int {
 	if s.string == 0 {
+		// Length errors are reported at the start of the length prefix,
+		// not at its delimiter.
+		prefix := s.bytes - int64(len(s.digits)) - 1
 		n, err := strconv.ParseUint(string(s.digits), 10, 64)
-		s.digits = s.digits[0:0]
 		if err != nil {
-			s.err = err
 			s.step = stateError
+			s.err = &SyntaxError{msg: "string length " + string(s.digits) + " out of range", Offset: prefix, Context: "string length out of range"}
+			s.digits = s.digits[0:0]
+			return scanError
+		}
+		s.digits = s.digits[0:0]
+		if s.maxString > 0 && n > s.maxString {
+			s.step = stateError
+			s.err = &SyntaxError{msg: "string length " + strconv.FormatUint(n, 10) + " exceeds maximum of " + strconv.FormatUint(s.maxString, 10), Offset: prefix, Context: "string length exceeds maximum"}
 			return scanError
 		}
 		s.string = n
@@ -269,7 +429,7 @@ func se(s *scanner, c byte) int {
 	case parseListValue:
 		return sl(s, c)
 	}
-	return s.error(c, "DNE")
+	return s.error(c, "in unknown parse state")
 }
 
 func sl(s *scanner, c byte) int {
@@ -291,18 +451,30 @@ func si(s *scanner, c byte) int {
 	}
 	if '1' <= c && c <= '9' {
 		s.step = sil
-		return scanInteger
+		return s.intDigit(scanInteger)
 	}
 	return s.error(c, "looking for integer")
 }
 
+// intDigit counts a digit of the integer being scanned, returning op unless
+// the integer has grown too long.
+func (s *scanner) intDigit(op int) int {
+	s.intDigits++
+	if s.maxIntDigits > 0 && s.intDigits > s.maxIntDigits {
+		s.step = stateError
+		s.err = &SyntaxError{msg: "integer exceeds maximum of " + strconv.Itoa(s.maxIntDigits) + " digits", Offset: s.intStart, Context: "integer exceeds maximum digits"}
+		return scanError
+	}
+	return op
+}
+
 func sin(s *scanner, c byte) int {
 	if c == '0' {
 		return s.error(c, "negative zero not allowed")
 	}
 	if '1' <= c && c <= '9' {
 		s.step = sil
-		return scanContinue
+		return s.intDigit(scanContinue)
 	}
 	return s.error(c, "looking for integer")
 }
@@ -321,7 +493,7 @@ func sil(s *scanner, c byte) int {
 		return scanEndInteger
 	}
 	if '0' <= c && c <= '9' {
-		return scanContinue
+		return s.intDigit(scanContinue)
 	}
 	return s.error(c, "looking for integer")
 }
@@ -55,3 +55,116 @@ func TestValid(t *testing.T) {
 		}
 	}
 }
+
+func TestValidStringLengthOverflow(t *testing.T) {
+	err := checkValid([]byte(`99999999999999999999999:a`), &scanner{})
+	if _, ok := err.(*SyntaxError); !ok {
+		t.Errorf("checkValid = %v, want *SyntaxError", err)
+	}
+}
+
+func TestScanner(t *testing.T) {
+	s := NewScanner()
+	for _, tt := range validTests {
+		s.Reset()
+		var err error
+		for i := 0; i < len(tt.data) && err == nil; i++ {
+			if s.Step(tt.data[i]) == TokenError {
+				err = s.Err()
+			}
+		}
+		if err == nil {
+			err = s.End()
+		}
+		if ok := err == nil; ok != tt.ok {
+			t.Errorf("Scanner on %#q: error %v, want ok %v", tt.data, err, tt.ok)
+		}
+	}
+
+	s.Reset()
+	var got []TokenType
+	for _, c := range []byte(`d1:ai12ee`) {
+		got = append(got, s.Step(c))
+	}
+	want := []TokenType{
+		TokenBeginDictionary,
+		TokenBeginString, TokenContinue, TokenString,
+		TokenBeginInteger, TokenInteger, TokenContinue, TokenEndInteger,
+		TokenEndDictionary,
+	}
+	if !s.Done() || len(got) != len(want) {
+		t.Fatalf("Step returned %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Step(%q) = %v, want %v", `d1:ai12ee`[i], got[i], want[i])
+		}
+	}
+	if tok := s.Step('x'); tok != TokenEnd {
+		t.Errorf("Step after value = %v, want TokenEnd", tok)
+	}
+
+	// Reset in the middle of a string.
+	s.Reset()
+	s.Step('5')
+	s.Step(':')
+	s.Reset()
+	for _, c := range []byte(`1:a`) {
+		s.Step(c)
+	}
+	if !s.Done() {
+		t.Errorf("Scanner not done after Reset and 1:a: %v", s.Err())
+	}
+}
+
+func TestSyntaxErrorContext(t *testing.T) {
+	for _, tt := range []struct {
+		data    string
+		context string
+	}{
+		{`x`, "looking for value"},
+		{`dx`, "looking for string length"},
+		{`di0ee`, "dictionary key not a string"},
+		{`d1:ai1eli1eei2ee`, "dictionary key not a string"},
+		{`0x`, "looking for string length delimiter"},
+		{`1x`, "looking for string length digit"},
+		{`ix`, "looking for integer"},
+		{`i-0e`, "negative zero not allowed"},
+		{`i01e`, "leading zeroes not allowed"},
+		{`i1`, "end of input"},
+		{`99999999999999999999999:`, "string length out of range"},
+	} {
+		err := checkValid([]byte(tt.data), &scanner{})
+		se, ok := err.(*SyntaxError)
+		if !ok {
+			t.Errorf("checkValid(%#q) = %v, want *SyntaxError", tt.data, err)
+			continue
+		}
+		if se.Context != tt.context {
+			t.Errorf("checkValid(%#q).Context = %q, want %q", tt.data, se.Context, tt.context)
+		}
+	}
+}
+
+func TestDictionaryKeyError(t *testing.T) {
+	for _, tt := range []struct {
+		data   string
+		offset int64
+		msg    string
+	}{
+		{`di0ee`, 1, "dictionary key at offset 1 is an integer, but dictionary keys must be strings"},
+		{`d1:a0:lee`, 6, "dictionary key at offset 6 is a list, but dictionary keys must be strings"},
+		{`ld1:ai1eded`, 8, "dictionary key at offset 8 is a dictionary, but dictionary keys must be strings"},
+	} {
+		var v interface{}
+		err := Unmarshal([]byte(tt.data), &v)
+		se, ok := err.(*SyntaxError)
+		if !ok {
+			t.Errorf("Unmarshal(%#q) = %v, want *SyntaxError", tt.data, err)
+			continue
+		}
+		if se.Offset != tt.offset || se.Error() != tt.msg {
+			t.Errorf("Unmarshal(%#q) = %q at offset %d, want %q at offset %d", tt.data, se, se.Offset, tt.msg, tt.offset)
+		}
+	}
+}
@@ -1,7 +1,17 @@
 package bencode
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
 	"io"
+	"reflect"
+	"sort"
+	"strconv"
 )
 
 type Decoder struct {
@@ -15,6 +25,13 @@ type Decoder struct {
 
 	tokenState int
 	tokenStack []int
+
+	// valueOffset is the stream offset of the value held in d.
+	valueOffset int64
+
+	// maxGrowth, if positive, is the most refill grows buf by, besides
+	// the minimum read size.
+	maxGrowth int
 }
 
 func NewDecoder(r io.Reader) *Decoder {
@@ -22,6 +39,470 @@ func NewDecoder(r io.Reader) *Decoder {
 }
 
 func (dec *Decoder) Decode(v interface{}) error {
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.Ptr && !rv.IsNil() && streamsSink(rv.Type().Elem()) {
+		return dec.decodeStreaming(rv.Elem())
+	}
+
+	if err := dec.next(); err != nil {
+		return err
+	}
+
+	err := dec.d.unmarshal(v)
+
+	dec.tokenValueEnd()
+
+	return dec.streamError(err)
+}
+
+// Decode reads a single bencode value from r and stores it in the value
+// pointed to by v. Unlike a Decoder, which reads a stream of values, Decode
+// expects r to hold nothing else and returns a SyntaxError if any data
+// follows the value.
+func Decode(r io.Reader, v interface{}) error {
+	dec := NewDecoder(r)
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+
+	var err error
+	for dec.scanp == len(dec.buf) && err == nil {
+		err = dec.refill()
+	}
+	if dec.scanp < len(dec.buf) {
+		return trailingDataError(dec.offset())
+	}
+	if err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// UseNumber causes the Decoder to unmarshal an integer into an interface{}
+// as a Number instead of as an int64.
+func (dec *Decoder) UseNumber() { dec.d.useNumber = true }
+
+// StringsAsNumbers makes the Decoder accept a bencode string holding a
+// decimal integer, such as 2:42, wherever it would accept a bencode integer
+// for a numeric Go value. Strings holding anything else are still an error.
+func (dec *Decoder) StringsAsNumbers() { dec.d.stringsAsNumbers = true }
+
+// FailFast makes Decode and the other methods decoding a value stop at the
+// first error that does not prevent decoding the rest of the value, such as
+// an UnmarshalTypeError, and return it right away. By default such errors are
+// saved, the rest of the value is decoded, and the first error is returned at
+// the end. The value being decoded is skipped either way, so the next Decode
+// starts with the following one.
+func (dec *Decoder) FailFast() { dec.d.failFast = true }
+
+// RequireFieldMatch makes it an error to decode a non-empty dictionary into a
+// struct without setting any of its fields. This catches structs whose
+// fields are all unexported or misnamed, which otherwise decode without
+// error and without effect. Dictionaries with only some unknown keys are not
+// affected.
+func (dec *Decoder) RequireFieldMatch() { dec.d.requireFieldMatch = true }
+
+// IntegerMapValuesAsStrings makes the Decoder accept a bencode integer for
+// the value of a map whose element type is a string, storing its decimal
+// digits, so that d3:fooi42ee decodes into a map[string]string as
+// {"foo": "42"}. It is the map value counterpart of the "numstring" tag
+// option. Integers for other strings, such as struct fields, are still an
+// error.
+func (dec *Decoder) IntegerMapValuesAsStrings() { dec.d.intMapStrings = true }
+
+// PreserveExistingSlices makes the Decoder append the elements of a list to
+// the slice it is decoded into. By default the slice is overwritten: it ends
+// up holding exactly the decoded elements, reusing its backing array when it
+// is large enough. Arrays are always overwritten from their first element.
+func (dec *Decoder) PreserveExistingSlices() { dec.d.preserveSlices = true }
+
+// SetNameMapper makes the Decoder translate dictionary keys before matching
+// them against struct fields. A key that matches a field's tag or name, as
+// it would without a mapper, is used as is; only keys that match no field
+// are passed to fn, and the name it returns is then matched the same way.
+// Explicit tags therefore always take precedence over the mapper. Keys of
+// maps are never mapped.
+func (dec *Decoder) SetNameMapper(fn func(bencodeKey []byte) string) {
+	dec.d.nameMapper = fn
+}
+
+// SetMaxListElements limits the number of elements a single bencode list may
+// hold. The limit applies to every list on its own, nested lists included,
+// and is not cumulative across the lists of a value. Decoding a list that
+// exceeds the limit stops with an error. A limit of zero or less, the
+// default, disables the check.
+func (dec *Decoder) SetMaxListElements(n int) {
+	dec.d.maxListElements = n
+}
+
+// InternKeys makes the Decoder reuse a single string for every occurrence of
+// the same dictionary key that it stores as a map key, across all values it
+// decodes, instead of allocating a new string each time. This saves memory
+// and allocations when decoding many similar values, such as a batch of
+// torrents, into maps. It costs a lookup per key, which is wasted on inputs
+// whose keys are all different, so it is off by default. Only the first
+// few thousand distinct keys are interned.
+func (dec *Decoder) InternKeys() {
+	if dec.d.internedKeys == nil {
+		dec.d.internedKeys = make(map[string]reflect.Value)
+	}
+}
+
+// SetMaxInterfaceNodes limits the number of nodes the Decoder creates while
+// decoding a single value into an empty interface, whether at the top level
+// or in a field, list or map of interface type. Every map, slice, string and
+// integer stored in the resulting tree counts as a node, so the limit bounds
+// the allocations an untrusted input of many tiny or deeply nested values can
+// cause. Decoding stops with an error wrapping ErrTooManyInterfaceNodes once
+// it is exceeded. Values decoded into concrete types are not counted. A limit
+// of zero or less, the default, disables the check. UnmarshalMaxInterfaceNodes
+// applies the same limit to a byte slice.
+func (dec *Decoder) SetMaxInterfaceNodes(n int) {
+	dec.d.maxInterfaceNodes = n
+}
+
+// SetMaxStringLen limits the declared length of any single bencode string
+// in the input to n bytes. A longer declaration is rejected with a
+// SyntaxError as soon as its length prefix has been read, before the Decoder
+// tries to buffer the string. A limit of zero, the default, disables the
+// check.
+func (dec *Decoder) SetMaxStringLen(n uint64) {
+	dec.scan.maxString = n
+}
+
+// SetMaxIntegerDigits limits the number of digits of any single bencode
+// integer in the input to n, so that a hostile integer millions of digits
+// long is rejected with a SyntaxError while it is being read instead of being
+// buffered and parsed. No int64 or uint64 needs more than 20 digits; larger
+// limits are only useful for values decoded into a RawMessage or by an
+// Unmarshaler, such as one backed by a big.Int. A limit of zero, the
+// default, disables the check.
+func (dec *Decoder) SetMaxIntegerDigits(n int) {
+	dec.scan.maxIntDigits = n
+}
+
+// ReadAll reads the rest of the Decoder's input into its buffer at once, so
+// that the values in it are decoded without reading any further. For small
+// inputs like most torrent files, this is faster than reading and growing the
+// buffer as values are decoded, and if the input has a Len method, like a
+// bytes.Reader, the buffer is allocated in one go. It must not be used with
+// large or unbounded inputs, which a Decoder otherwise reads in pieces. An
+// error reading the input is returned by the first Decode, Token or other
+// read that needs more data than ReadAll buffered.
+func (dec *Decoder) ReadAll() {
+	if l, ok := dec.r.(interface{ Len() int }); ok {
+		if n := len(dec.buf) + l.Len() + 1; n > cap(dec.buf) {
+			newBuf := make([]byte, len(dec.buf), n)
+			copy(newBuf, dec.buf)
+			dec.buf = newBuf
+		}
+	}
+	for {
+		if len(dec.buf) == cap(dec.buf) {
+			newBuf := make([]byte, len(dec.buf), 2*cap(dec.buf)+512)
+			copy(newBuf, dec.buf)
+			dec.buf = newBuf
+		}
+		n, err := dec.r.Read(dec.buf[len(dec.buf):cap(dec.buf)])
+		dec.buf = dec.buf[:len(dec.buf)+n]
+		if err != nil {
+			dec.r = errReader{err}
+			return
+		}
+	}
+}
+
+// errReader is a reader that always fails with err.
+type errReader struct {
+	err error
+}
+
+func (r errReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
+// SetMaxBufferGrowth limits how much the Decoder grows its read buffer at a
+// time to n bytes, plus the 512 bytes of its smallest read. By default the
+// buffer doubles whenever it is full, which keeps the number of copies low
+// but can leave up to half of it unused after reading a large value. With a
+// limit, the buffer grows in steps of n bytes once it is larger than n,
+// following the size of the values more closely at the cost of more copying.
+// A limit of zero or less restores doubling.
+func (dec *Decoder) SetMaxBufferGrowth(n int) {
+	dec.maxGrowth = n
+}
+
+// DecodeKeys is like Decode but only decodes the values of the given keys
+// of a top-level dictionary, skipping over all others without decoding them.
+// Dictionaries nested in the decoded values are decoded completely. This
+// makes reading a few fields of a large value, such as the name of a torrent
+// but not its pieces, cheaper than a full Decode. Skipped keys count as
+// absent, so the struct fields they would set get their "default" values and
+// are reported as missing if they are "required".
+func (dec *Decoder) DecodeKeys(v interface{}, keys ...string) error {
+	if err := dec.next(); err != nil {
+		return err
+	}
+
+	if dec.d.data[0] == 'd' {
+		dec.d.onlyKeys = make(map[string]bool, len(keys))
+		for _, k := range keys {
+			dec.d.onlyKeys[k] = true
+		}
+	}
+	err := dec.d.unmarshal(v)
+	dec.d.onlyKeys = nil
+
+	dec.tokenValueEnd()
+
+	return dec.streamError(err)
+}
+
+// DecodeInto is like Decode but also returns the struct fields that were set
+// from the input, sorted and named by their paths as in UnmarshalWithPresence.
+// Decoding a partial update into an existing struct leaves all other fields
+// untouched, so updated lists exactly the fields the update changed.
+func (dec *Decoder) DecodeInto(v interface{}) (updated []string, err error) {
+	if err := dec.next(); err != nil {
+		return nil, err
+	}
+
+	dec.d.present = make(map[string]bool)
+	err = dec.d.unmarshal(v)
+	for path := range dec.d.present {
+		updated = append(updated, path)
+	}
+	sort.Strings(updated)
+	dec.d.present = nil
+
+	dec.tokenValueEnd()
+
+	return updated, dec.streamError(err)
+}
+
+// InfoHash reads the next value from its input, which must be a torrent's
+// metainfo dictionary, and returns the SHA-1 hash of its info dictionary,
+// the info-hash of a BitTorrent v1 torrent. Unlike ParseTorrent, it hashes
+// the info dictionary as it is read and keeps neither it nor the rest of the
+// torrent in memory, so it can hash a torrent of any size. The value is not
+// decoded; use Decode on a separate reader for that.
+func (dec *Decoder) InfoHash() (sum [20]byte, err error) {
+	h := sha1.New()
+	if err = dec.infoHash(h); err == nil {
+		h.Sum(sum[:0])
+	}
+	return sum, err
+}
+
+// InfoHashV2 is like InfoHash but returns the SHA-256 hash of the info
+// dictionary, the info-hash of a BitTorrent v2 torrent as described by
+// BEP 52.
+func (dec *Decoder) InfoHashV2() (sum [32]byte, err error) {
+	h := sha256.New()
+	if err = dec.infoHash(h); err == nil {
+		h.Sum(sum[:0])
+	}
+	return sum, err
+}
+
+// infoHash scans the next value like readValue, writing the bytes of the
+// value of its top-level info key to h. Scanned bytes are dropped from buf as
+// soon as they have been hashed instead of being kept until the end of the
+// value.
+func (dec *Decoder) infoHash(h hash.Hash) error {
+	if dec.err != nil {
+		return dec.err
+	}
+	if !dec.tokenValueAllowed() {
+		return &SyntaxError{msg: "not at beginning of value", Offset: dec.offset(), Context: "looking for value"}
+	}
+
+	const infoKey = "4:info"
+	var (
+		key      []byte
+		inKey    bool
+		hashing  bool
+		found    bool
+		consumed bool
+		err      error
+	)
+	dec.scan.reset()
+	for {
+		start := dec.scanp
+		hashStart := start
+		for i, c := range dec.buf[start:] {
+			dec.scan.bytes++
+			op := dec.scan.step(&dec.scan, c)
+			if op == scanError {
+				dec.err = dec.scan.err
+				return dec.scan.err
+			}
+			if !consumed && op != scanBeginDictionary {
+				dec.err = errors.New("bencode: torrent is not a dictionary")
+				return dec.err
+			}
+			consumed = true
+
+			// A top-level key or value starts by pushing a second
+			// parse state onto that of the top-level dictionary.
+			ps := dec.scan.parseState
+			if len(ps) == 2 && op != scanContinue && op != scanString {
+				switch ps[0] {
+				case parseDictionaryKey:
+					if op == scanBeginString && !inKey {
+						key, inKey = key[:0], true
+					}
+				case parseDictionaryValue:
+					if string(key) == infoKey && !hashing {
+						if found {
+							dec.err = errors.New("bencode: torrent has more than one info dictionary")
+							return dec.err
+						}
+						hashing, found = true, true
+						hashStart = start + i
+					}
+				}
+			}
+			if inKey && len(key) < len(infoKey) {
+				key = append(key, c)
+			}
+			if len(ps) < 2 {
+				if inKey {
+					inKey = false
+				} else if hashing && len(ps) == 1 {
+					h.Write(dec.buf[hashStart : start+i+1])
+					hashing = false
+					key = key[:0]
+				}
+			}
+			if len(ps) == 0 {
+				dec.scanp = start + i + 1
+				dec.tokenValueEnd()
+				if !found {
+					return errors.New("bencode: torrent has no info dictionary")
+				}
+				return nil
+			}
+		}
+		if hashing {
+			h.Write(dec.buf[hashStart:])
+		}
+		dec.scanp = len(dec.buf)
+
+		if err != nil {
+			if err == io.EOF && consumed {
+				err = io.ErrUnexpectedEOF
+			}
+			dec.err = err
+			return err
+		}
+		err = dec.refill()
+	}
+}
+
+// DecodeToChan reads the next bencode list from its input and sends each
+// element on ch, which must be a channel that can be sent on. Every element
+// is decoded into a new value of the channel's element type and sent before
+// the following element is decoded. DecodeToChan does not close ch.
+func (dec *Decoder) DecodeToChan(ch interface{}) error {
+	cv := reflect.ValueOf(ch)
+	if cv.Kind() != reflect.Chan || cv.IsNil() || cv.Type().ChanDir()&reflect.SendDir == 0 {
+		return fmt.Errorf("bencode: DecodeToChan(non-sendable %v)", reflect.TypeOf(ch))
+	}
+
+	if err := dec.next(); err != nil {
+		return err
+	}
+
+	et := cv.Type().Elem()
+	err := dec.d.listEach(cv.Type(), func() reflect.Value {
+		return reflect.New(et).Elem()
+	}, func(i int, v reflect.Value) error {
+		cv.Send(v)
+		return nil
+	})
+
+	dec.tokenValueEnd()
+
+	return dec.streamError(err)
+}
+
+// EachListElement reads the next bencode list from its input and decodes its
+// elements one at a time into the value pointed to by v, calling fn with the
+// element's index after each one. The value is reset to its zero value
+// before every element, so fn must copy out anything it wants to keep.
+// Decoding stops at the first error, including one returned by fn.
+func (dec *Decoder) EachListElement(v interface{}, fn func(i int) error) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return &InvalidUnmarshalError{reflect.TypeOf(v)}
+	}
+
+	if err := dec.next(); err != nil {
+		return err
+	}
+
+	ev := rv.Elem()
+	zero := reflect.Zero(ev.Type())
+	err := dec.d.listEach(reflect.SliceOf(ev.Type()), func() reflect.Value {
+		ev.Set(zero)
+		return rv
+	}, func(i int, _ reflect.Value) error {
+		return fn(i)
+	})
+
+	dec.tokenValueEnd()
+
+	return dec.streamError(err)
+}
+
+// Resync recovers from a syntax error in the input so that decoding can
+// continue with the values after the malformed one, as when reading an
+// append-only log with a corrupted entry. Normally, once Decode has returned
+// a SyntaxError, it returns the same error on every later call.
+//
+// Resync is heuristic: it discards the input up to and including the byte at
+// which the error was found, and then every byte that cannot start a value.
+// The next Decode may therefore start in the middle of the bad value, for
+// example at a digit that was part of a string, and fail again; calling
+// Resync again makes further progress each time. Resync returns nil if dec
+// had no error, and the error unchanged if it was not a SyntaxError, such as
+// an error reading the input, which cannot be recovered from.
+func (dec *Decoder) Resync() error {
+	if dec.err == nil {
+		return nil
+	}
+	if _, ok := dec.err.(*SyntaxError); !ok {
+		return dec.err
+	}
+
+	// Scan the bad value again to find the byte it failed at.
+	scan := scanner{maxString: dec.scan.maxString, maxIntDigits: dec.scan.maxIntDigits}
+	scan.reset()
+	i := dec.scanp
+	for i < len(dec.buf) {
+		c := dec.buf[i]
+		i++
+		if scan.step(&scan, c) == scanError {
+			break
+		}
+	}
+	for i < len(dec.buf) && !isValueStart(dec.buf[i]) {
+		i++
+	}
+
+	dec.scanp = i
+	dec.err = nil
+	return nil
+}
+
+// isValueStart reports whether c can be the first byte of a bencode value.
+func isValueStart(c byte) bool {
+	return c == 'd' || c == 'l' || c == 'i' || '0' <= c && c <= '9'
+}
+
+// next reads the next complete value from the input and prepares dec.d to
+// decode it.
+func (dec *Decoder) next() error {
 	if dec.err != nil {
 		return dec.err
 	}
@@ -31,7 +512,7 @@ func (dec *Decoder) Decode(v interface{}) error {
 	}
 
 	if !dec.tokenValueAllowed() {
-		return &SyntaxError{msg: "not at beginning of value", Offset: dec.offset()}
+		return &SyntaxError{msg: "not at beginning of value", Offset: dec.offset(), Context: "looking for value"}
 	}
 
 	n, err := dec.readValue()
@@ -39,12 +520,23 @@ func (dec *Decoder) Decode(v interface{}) error {
 		return err
 	}
 	dec.d.init(dec.buf[dec.scanp : dec.scanp+n])
+	dec.valueOffset = dec.offset()
 	dec.scanp += n
+	return nil
+}
 
-	err = dec.d.unmarshal(v)
-
-	dec.tokenValueEnd()
-
+// streamError translates the offset of an error returned while decoding the
+// current value, which is relative to the value, into an offset in the
+// stream.
+func (dec *Decoder) streamError(err error) error {
+	switch err := err.(type) {
+	case *UnmarshalTypeError:
+		err.Offset += dec.valueOffset
+	case *OverflowError:
+		err.Offset += dec.valueOffset
+	case *SyntaxError:
+		err.Offset += dec.valueOffset
+	}
 	return err
 }
 
@@ -78,10 +570,7 @@ Input:
 		scanp = len(dec.buf)
 
 		if err != nil {
-			if err == io.EOF {
-				if dec.scan.bytes == 0 {
-					break Input
-				}
+			if err == io.EOF && scanp > dec.scanp {
 				err = io.ErrUnexpectedEOF
 			}
 			dec.err = err
@@ -105,7 +594,11 @@ func (dec *Decoder) refill() error {
 
 	const minRead = 512
 	if cap(dec.buf)-len(dec.buf) < minRead {
-		newBuf := make([]byte, len(dec.buf), 2*cap(dec.buf)+minRead)
+		grow := cap(dec.buf)
+		if dec.maxGrowth > 0 && grow > dec.maxGrowth {
+			grow = dec.maxGrowth
+		}
+		newBuf := make([]byte, len(dec.buf), cap(dec.buf)+grow+minRead)
 		copy(newBuf, dec.buf)
 		dec.buf = newBuf
 	}
@@ -116,6 +609,581 @@ func (dec *Decoder) refill() error {
 	return err
 }
 
+// decodeStreaming is Decode for a value v holding a StringSink, see
+// streamsSink. Only the values not leading to a StringSink are buffered.
+func (dec *Decoder) decodeStreaming(v reflect.Value) error {
+	if dec.err != nil {
+		return dec.err
+	}
+	if err := dec.tokenPrepareForDecode(); err != nil {
+		return err
+	}
+	if !dec.tokenValueAllowed() {
+		return &SyntaxError{msg: "not at beginning of value", Offset: dec.offset(), Context: "looking for value"}
+	}
+	if _, err := dec.peek(); err != nil {
+		dec.err = err
+		return err
+	}
+
+	dec.d.init(nil)
+	err := func() (err error) {
+		defer recoverAbort(&err)
+		return dec.streamValue(v)
+	}()
+	if err != nil {
+		// The rest of the value is still in the input.
+		dec.err = err
+		return err
+	}
+	dec.tokenValueEnd()
+	return dec.d.savedError
+}
+
+// streamValue decodes the next value of the input into v, whose type
+// satisfies streamsSink.
+func (dec *Decoder) streamValue(v reflect.Value) error {
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+	}
+	c, err := dec.streamPeek()
+	if err != nil {
+		return err
+	}
+	if v.Type() == stringSinkType && '0' <= c && c <= '9' {
+		w := v.Interface().(StringSink).W
+		if w == nil {
+			dec.d.saveError(errors.New("bencode: StringSink with nil Writer"))
+			w = io.Discard
+		}
+		return dec.streamString(w)
+	}
+	if v.Kind() == reflect.Struct && c == 'd' {
+		return dec.streamDictionary(v)
+	}
+	return dec.streamBuffered(v, nil, nil)
+}
+
+// streamDictionary decodes the dictionary at the start of the input into the
+// struct v, streaming the values of fields that lead to a StringSink.
+func (dec *Decoder) streamDictionary(v reflect.Value) error {
+	start := dec.offset()
+	dec.scanp++
+	dec.scan.bytes++
+
+	t := v.Type()
+	fields, _ := cachedTypeFields(t)
+	seen := make([]bool, len(fields))
+	empty := true
+	for {
+		c, err := dec.streamPeek()
+		if err != nil {
+			return err
+		}
+		if c == 'e' {
+			dec.scanp++
+			dec.scan.bytes++
+			break
+		}
+		if c < '0' || c > '9' {
+			return dec.streamSyntaxError(c, "looking for dictionary key")
+		}
+		empty = false
+
+		n, err := dec.readValue()
+		if err != nil {
+			return err
+		}
+		item := dec.buf[dec.scanp : dec.scanp+n]
+		key := item[bytes.IndexByte(item, ':')+1:]
+		i := fieldByName(fields, key)
+		if i < 0 && dec.d.nameMapper != nil {
+			i = fieldByName(fields, []byte(dec.d.nameMapper(key)))
+		}
+		if i < 0 && dec.d.disallowUnknownFields {
+			dec.d.saveError(fmt.Errorf("bencode: unknown field %q", key))
+		}
+		dec.scanp += n
+
+		if c, err = dec.streamPeek(); err != nil {
+			return err
+		}
+		if !isValueStart(c) {
+			return dec.streamSyntaxError(c, "after dictionary key")
+		}
+
+		var f *field
+		var subv reflect.Value
+		if i >= 0 {
+			f = &fields[i]
+			seen[i] = true
+			subv = fieldValue(v, f.index)
+		}
+		if subv.IsValid() && streamsSink(subv.Type()) {
+			err = dec.streamValue(subv)
+		} else {
+			err = dec.streamBuffered(subv, t, f)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if dec.d.requireFieldMatch && !empty {
+		matched := false
+		for i := range seen {
+			matched = matched || seen[i]
+		}
+		if !matched {
+			dec.d.saveError(fmt.Errorf("bencode: no key of dictionary at offset %d matches an exported field of Go struct %v", start, t))
+		}
+	}
+	dec.d.checkRequired(t, fields, seen)
+	dec.d.storeDefaults(v, fields, seen)
+	return nil
+}
+
+// streamString copies the string at the start of the input to w in chunks
+// of at most the size of the Decoder's buffer.
+func (dec *Decoder) streamString(w io.Writer) error {
+	dec.scan.reset()
+	for {
+		c, err := dec.streamPeek()
+		if err != nil {
+			return err
+		}
+		dec.scan.bytes++
+		if dec.scan.step(&dec.scan, c) == scanError {
+			dec.err = dec.scan.err
+			return dec.err
+		}
+		dec.scanp++
+		if c == ':' {
+			break
+		}
+	}
+
+	for n := dec.scan.string; n > 0; {
+		if _, err := dec.streamPeek(); err != nil {
+			return err
+		}
+		chunk := dec.buf[dec.scanp:]
+		if uint64(len(chunk)) > n {
+			chunk = chunk[:n]
+		}
+		if _, err := w.Write(chunk); err != nil {
+			// The rest of the string is still in the input.
+			dec.err = err
+			return err
+		}
+		dec.scanp += len(chunk)
+		dec.scan.bytes += int64(len(chunk))
+		n -= uint64(len(chunk))
+	}
+	dec.scan.reset()
+	return nil
+}
+
+// streamBuffered reads the next complete value of the input and decodes it
+// into v, which is the field f of a struct of type t if f is not nil,
+// keeping the first error saved so far.
+func (dec *Decoder) streamBuffered(v reflect.Value, t reflect.Type, f *field) error {
+	n, err := dec.readValue()
+	if err != nil {
+		return err
+	}
+	saved := dec.d.savedError
+	dec.d.init(dec.buf[dec.scanp : dec.scanp+n])
+	if f != nil {
+		dec.d.errorContext.Struct = t
+		dec.d.errorContext.Field = f.name
+		dec.d.numString = f.numString
+	}
+	dec.valueOffset = dec.offset()
+	dec.scanp += n
+
+	err = dec.d.unmarshalValue(v)
+	if err != nil && err != dec.d.savedError {
+		return dec.streamError(err)
+	}
+	if saved == nil && err != nil {
+		saved = dec.streamError(err)
+	}
+	dec.d.savedError = saved
+	return nil
+}
+
+// streamPeek is peek for the inside of a value, where the input must not
+// end.
+func (dec *Decoder) streamPeek() (byte, error) {
+	c, err := dec.peek()
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		dec.err = err
+	}
+	return c, err
+}
+
+// streamSyntaxError returns a SyntaxError for the unexpected byte c, which
+// stops the Decoder.
+func (dec *Decoder) streamSyntaxError(c byte, context string) error {
+	dec.err = &SyntaxError{msg: "invalid character " + quoteChar(c) + " " + context, Offset: dec.offset() + 1, Context: context}
+	return dec.err
+}
+
+// CopyValue copies exactly one bencode value from src to dst without
+// decoding it, checking that it is valid as it goes, and returns the number
+// of bytes written. The value is copied in chunks as it is read, so it can be
+// of any size.
+//
+// If src is a *bufio.Reader, CopyValue reads no further than the end of the
+// value, leaving whatever follows in src. Any other reader is wrapped in a
+// bufio.Reader, which may read past the end of the value; those bytes are
+// lost. If src holds invalid bencode, CopyValue returns a SyntaxError, and
+// dst may have received the valid bytes before the error.
+func CopyValue(dst io.Writer, src io.Reader) (n int64, err error) {
+	br, ok := src.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(src)
+	}
+
+	var scan scanner
+	scan.reset()
+	for {
+		if _, err := br.Peek(1); err != nil {
+			if err == io.EOF && scan.bytes > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return n, err
+		}
+		buf, _ := br.Peek(br.Buffered())
+
+		end, done := len(buf), false
+		for i, c := range buf {
+			scan.bytes++
+			if scan.step(&scan, c) == scanError {
+				return n, scan.err
+			}
+			if len(scan.parseState) == 0 {
+				end, done = i+1, true
+				break
+			}
+		}
+
+		w, err := dst.Write(buf[:end])
+		n += int64(w)
+		br.Discard(w)
+		if err != nil {
+			return n, err
+		}
+		if done {
+			return n, nil
+		}
+	}
+}
+
+// An Encoder writes bencode values to an output stream.
+type Encoder struct {
+	w        io.Writer
+	err      error
+	trustRaw bool
+	opts     encOpts
+}
+
+// NewEncoder returns a new encoder that writes to w.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// Encode writes the bencode encoding of v to the stream.
+//
+// See the documentation for Marshal for details about the
+// conversion of Go values to bencode.
+func (enc *Encoder) Encode(v interface{}) error {
+	if enc.err != nil {
+		return enc.err
+	}
+	e := newEncodeState()
+	e.w = enc.w
+	err := e.marshal(v, enc.opts)
+	if err != nil {
+		// Part of the value may already have been written.
+		if e.streamed {
+			enc.err = err
+		}
+		return err
+	}
+
+	if _, err = enc.w.Write(e.Bytes()); err != nil {
+		enc.err = err
+	}
+	encodeStatePool.Put(e)
+	return err
+}
+
+// WriteRaw writes r, which must already be bencode, to the stream without
+// decoding it. Unless SetTrustRaw has been enabled, r is validated first and
+// nothing is written if it is not valid bencode.
+func (enc *Encoder) WriteRaw(r RawMessage) error {
+	if enc.err != nil {
+		return enc.err
+	}
+	if !enc.trustRaw {
+		if err := checkValid(r, &scanner{}); err != nil {
+			return err
+		}
+	}
+
+	_, err := enc.w.Write(r)
+	if err != nil {
+		enc.err = err
+	}
+	return err
+}
+
+// SetTrustRaw controls whether WriteRaw skips validating its input. It should
+// only be enabled for bytes that are known to be valid bencode, such as those
+// produced by Marshal or received from a Decoder.
+func (enc *Encoder) SetTrustRaw(on bool) {
+	enc.trustRaw = on
+}
+
+// SetKeyMapper makes the Encoder derive the dictionary key of every struct
+// field that has no name in its tag by calling fn with the field's Go name,
+// so that for example strings.ToLower encodes a field Name as "name". A name
+// given in a tag always wins over fn. The keys of each dictionary are sorted
+// after they have been mapped, so the output stays canonical, and it is an
+// error for fn to map two fields of a struct to the same key. This is the
+// counterpart of Decoder.SetNameMapper. A nil fn restores the default.
+func (enc *Encoder) SetKeyMapper(fn func(goFieldName string) string) {
+	enc.opts.keyMapper = fn
+	enc.opts.structFields = make(map[reflect.Type][]field)
+}
+
+// SetFieldOrder makes the Encoder write the keys of struct type t, or the
+// struct type t points to, in the given order instead of sorted, for peers
+// that expect the keys of a dictionary in some fixed order. order holds
+// dictionary keys, after any mapping by SetKeyMapper; keys of t missing from
+// it follow those in it, sorted. Names in order that are not keys of t are
+// ignored. The result is valid but not canonical bencode, and so not suited
+// for dictionaries that are hashed, like a torrent's info. A nil order
+// restores sorting for t.
+func (enc *Encoder) SetFieldOrder(t reflect.Type, order []string) {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	enc.opts.structFields = make(map[reflect.Type][]field)
+	if order == nil {
+		delete(enc.opts.fieldOrder, t)
+		return
+	}
+	if enc.opts.fieldOrder == nil {
+		enc.opts.fieldOrder = make(map[reflect.Type]map[string]int)
+	}
+	positions := make(map[string]int, len(order))
+	for i, name := range order {
+		if _, ok := positions[name]; !ok {
+			positions[name] = i
+		}
+	}
+	enc.opts.fieldOrder[t] = positions
+}
+
+// UseStringer controls whether the Encoder encodes values that implement
+// fmt.Stringer or error as bencode strings, which is handy for structs that
+// are only written for logging or debugging. The methods are tried in this
+// order of precedence:
+//
+//	Marshaler, MarshalBencode
+//	encoding.TextMarshaler, MarshalText
+//	fmt.Stringer, String (only with UseStringer)
+//	error, Error (only with UseStringer)
+//
+// and values implementing none of them are encoded as usual. Methods with a
+// pointer receiver are only used for addressable values, as for Marshaler.
+// Marshaler and encoding.TextMarshaler are always used.
+func (enc *Encoder) UseStringer(on bool) { enc.opts.useStringer = on }
+
+// StreamEncoder writes bencode dictionaries to an output stream one key at a
+// time, so that a large value such as the info dictionary of a torrent with
+// megabytes of pieces never has to be held in memory as a whole. Keys are
+// not buffered: the keys of each dictionary must be written in increasing
+// byte order, as canonical bencode requires, and any other order is an error.
+//
+// Dictionaries may be nested by calling BeginDict in place of Value. Once a
+// write to the underlying writer has failed, every method returns that error.
+type StreamEncoder struct {
+	w     io.Writer
+	err   error
+	dicts []streamDict
+}
+
+// streamDict is the state of a dictionary opened by BeginDict.
+type streamDict struct {
+	key    string
+	hasKey bool // a key has been written
+	value  bool // the last key written is still waiting for its value
+}
+
+// NewStreamEncoder returns a new stream encoder that writes to w.
+func NewStreamEncoder(w io.Writer) *StreamEncoder {
+	return &StreamEncoder{w: w}
+}
+
+// BeginDict starts a dictionary, either at the top level or as the value of
+// the last key written.
+func (s *StreamEncoder) BeginDict() error {
+	if err := s.beginValue(); err != nil {
+		return err
+	}
+	if err := s.write([]byte{'d'}); err != nil {
+		return err
+	}
+	s.dicts = append(s.dicts, streamDict{})
+	return nil
+}
+
+// Key writes the next key of the innermost open dictionary. It must sort
+// after the dictionary's previous key.
+func (s *StreamEncoder) Key(key string) error {
+	if s.err != nil {
+		return s.err
+	}
+	if len(s.dicts) == 0 {
+		return errors.New("bencode: StreamEncoder.Key outside of a dictionary")
+	}
+	d := &s.dicts[len(s.dicts)-1]
+	if d.value {
+		return fmt.Errorf("bencode: StreamEncoder.Key %q before value of key %q", key, d.key)
+	}
+	if d.hasKey && key <= d.key {
+		return fmt.Errorf("bencode: StreamEncoder.Key %q does not sort after %q", key, d.key)
+	}
+	if err := s.writeString(key); err != nil {
+		return err
+	}
+	d.key, d.hasKey, d.value = key, true, true
+	return nil
+}
+
+// Value writes the bencode encoding of v, either at the top level or as the
+// value of the last key written. Strings and byte slices are written to the
+// stream directly rather than being copied first.
+//
+// See the documentation for Marshal for details about the
+// conversion of Go values to bencode.
+func (s *StreamEncoder) Value(v interface{}) error {
+	if err := s.beginValue(); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case string:
+		return s.writeString(v)
+	case []byte:
+		if err := s.write([]byte(strconv.Itoa(len(v)) + ":")); err != nil {
+			return err
+		}
+		return s.write(v)
+	}
+
+	e := newEncodeState()
+	e.w = s.w
+	err := e.marshal(v, encOpts{})
+	if err != nil {
+		if e.streamed {
+			s.err = err
+		}
+		return err
+	}
+	err = s.write(e.Bytes())
+	encodeStatePool.Put(e)
+	return err
+}
+
+// EndDict ends the innermost open dictionary.
+func (s *StreamEncoder) EndDict() error {
+	if s.err != nil {
+		return s.err
+	}
+	if len(s.dicts) == 0 {
+		return errors.New("bencode: StreamEncoder.EndDict without BeginDict")
+	}
+	if d := &s.dicts[len(s.dicts)-1]; d.value {
+		return fmt.Errorf("bencode: StreamEncoder.EndDict before value of key %q", d.key)
+	}
+	if err := s.write([]byte{'e'}); err != nil {
+		return err
+	}
+	s.dicts = s.dicts[:len(s.dicts)-1]
+	return nil
+}
+
+// beginValue checks that a value may be written now and, if it is the value
+// of a key, marks that key as having one.
+func (s *StreamEncoder) beginValue() error {
+	if s.err != nil {
+		return s.err
+	}
+	if len(s.dicts) == 0 {
+		return nil
+	}
+	d := &s.dicts[len(s.dicts)-1]
+	if !d.value {
+		return errors.New("bencode: StreamEncoder value without a key")
+	}
+	d.value = false
+	return nil
+}
+
+func (s *StreamEncoder) writeString(str string) error {
+	return s.write([]byte(strconv.Itoa(len(str)) + ":" + str))
+}
+
+func (s *StreamEncoder) write(b []byte) error {
+	if _, err := s.w.Write(b); err != nil {
+		s.err = err
+		return err
+	}
+	return nil
+}
+
+// RawMessage is a raw encoded bencode value.
+// It implements Marshaler and Unmarshaler and can
+// be used to delay bencode decoding or precompute a bencode encoding.
+type RawMessage []byte
+
+var rawMessageType = reflect.TypeOf(RawMessage(nil))
+
+// MarshalBencode returns m as the bencode encoding of m.
+func (m RawMessage) MarshalBencode() ([]byte, error) {
+	if m == nil {
+		return nil, errors.New("bencode: MarshalBencode on nil RawMessage")
+	}
+	return m, nil
+}
+
+// UnmarshalBencode sets *m to a copy of data.
+func (m *RawMessage) UnmarshalBencode(data []byte) error {
+	if m == nil {
+		return errors.New("bencode.RawMessage: UnmarshalBencode on nil pointer")
+	}
+	*m = append((*m)[0:0], data...)
+	return nil
+}
+
+var _ Marshaler = (*RawMessage)(nil)
+var _ Unmarshaler = (*RawMessage)(nil)
+
+// A Token holds a value of one of these types:
+//
+//	Delim, for the delimiters d, l and e
+//	int64, for bencode integers (or Number if UseNumber was called)
+//	string, for bencode strings, including dictionary keys
 type Token interface{}
 
 const (
@@ -133,9 +1201,11 @@ func (dec *Decoder) tokenPrepareForDecode() error {
 	return nil
 }
 
+// tokenValueAllowed reports whether a value may be read in the current token
+// state: at the top level, as a list element, or after a dictionary key.
 func (dec *Decoder) tokenValueAllowed() bool {
 	switch dec.tokenState {
-	case tokenTopValue:
+	case tokenTopValue, tokenListStart, tokenListValue, tokenDictKey:
 		return true
 	}
 	return false
@@ -143,6 +1213,126 @@ func (dec *Decoder) tokenValueAllowed() bool {
 
 func (dec *Decoder) tokenValueEnd() {
 	switch dec.tokenState {
+	case tokenListStart:
+		dec.tokenState = tokenListValue
+	case tokenDictKey:
+		dec.tokenState = tokenDictValue
+	}
+}
+
+// A Delim is a bencode delimiter: d for the start of a dictionary, l for the
+// start of a list and e for the end of either.
+type Delim byte
+
+func (d Delim) String() string {
+	return string(d)
+}
+
+// Token returns the next bencode token in the input stream. At the end of
+// the input stream, Token returns nil, io.EOF.
+//
+// Token guarantees that the delimiters it returns are properly nested and
+// matched: if Token encounters an unexpected delimiter in the input, it will
+// return an error. Dictionary keys are returned as strings and must be
+// followed by their value.
+//
+// Token and Decode can be mixed: after Token has returned the start of a
+// list, Decode reads the next element as a whole. So a list such as
+// l4:ping d1:ai1ee e, holding a type and a payload whose Go type depends on
+// it, can be decoded by calling Token three times, for the l and the type,
+// choosing the payload's type and decoding into it, and calling Token once
+// more for the e.
+func (dec *Decoder) Token() (Token, error) {
+	c, err := dec.peek()
+	if err != nil {
+		return nil, err
+	}
+	switch c {
+	case 'd', 'l':
+		if !dec.tokenValueAllowed() {
+			return dec.tokenError(c)
+		}
+		dec.scanp++
+		dec.scan.bytes++
+		dec.tokenStack = append(dec.tokenStack, dec.tokenState)
+		if c == 'd' {
+			dec.tokenState = tokenDictStart
+		} else {
+			dec.tokenState = tokenListStart
+		}
+		return Delim(c), nil
+
+	case 'e':
+		switch dec.tokenState {
+		case tokenDictStart, tokenDictValue, tokenListStart, tokenListValue:
+		default:
+			return dec.tokenError(c)
+		}
+		dec.scanp++
+		dec.scan.bytes++
+		dec.tokenState = dec.tokenStack[len(dec.tokenStack)-1]
+		dec.tokenStack = dec.tokenStack[:len(dec.tokenStack)-1]
+		dec.tokenValueEnd()
+		return Delim(c), nil
+	}
+
+	if dec.tokenState == tokenDictStart || dec.tokenState == tokenDictValue {
+		if c < '0' || c > '9' {
+			return dec.tokenError(c)
+		}
+		dec.tokenState = tokenTopValue
+		var key string
+		err := dec.Decode(&key)
+		dec.tokenState = tokenDictKey
+		if err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+
+	if !dec.tokenValueAllowed() {
+		return dec.tokenError(c)
+	}
+	var x interface{}
+	if err := dec.Decode(&x); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// tokenError returns a SyntaxError for the unexpected byte c.
+func (dec *Decoder) tokenError(c byte) (Token, error) {
+	var context string
+	switch dec.tokenState {
+	case tokenTopValue, tokenListStart, tokenListValue:
+		context = "looking for value"
+	case tokenDictStart, tokenDictValue:
+		context = "looking for dictionary key"
+	case tokenDictKey:
+		context = "looking for dictionary value"
+	}
+	return nil, &SyntaxError{msg: "invalid character " + quoteChar(c) + " " + context, Offset: dec.offset() + 1, Context: context}
+}
+
+// More reports whether there is another element in the current list or
+// dictionary being read by Token, or another value in the input stream at
+// the top level.
+func (dec *Decoder) More() bool {
+	c, err := dec.peek()
+	return err == nil && c != 'e'
+}
+
+// peek returns the next byte of input without consuming it.
+func (dec *Decoder) peek() (byte, error) {
+	var err error
+	for {
+		if dec.scanp < len(dec.buf) {
+			return dec.buf[dec.scanp], nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		err = dec.refill()
 	}
 }
 
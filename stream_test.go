@@ -0,0 +1,1395 @@
+package bencode
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/netip"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"unsafe"
+)
+
+func TestDecodeToChan(t *testing.T) {
+	type record struct {
+		Name string `bencode:"name"`
+		Size int    `bencode:"size"`
+	}
+
+	dec := NewDecoder(strings.NewReader(`ld4:name1:a4:sizei1eed4:name1:b4:sizei2eee`))
+	ch := make(chan record, 2)
+	if err := dec.DecodeToChan(ch); err != nil {
+		t.Fatal(err)
+	}
+	close(ch)
+
+	var got []record
+	for r := range ch {
+		got = append(got, r)
+	}
+	if len(got) != 2 || got[0] != (record{"a", 1}) || got[1] != (record{"b", 2}) {
+		t.Errorf("DecodeToChan sent %v", got)
+	}
+}
+
+func TestDecodeToChanErrors(t *testing.T) {
+	if err := NewDecoder(strings.NewReader(`le`)).DecodeToChan(make(<-chan int)); err == nil {
+		t.Error("DecodeToChan accepted a receive-only channel")
+	}
+	if err := NewDecoder(strings.NewReader(`le`)).DecodeToChan([]int{}); err == nil {
+		t.Error("DecodeToChan accepted a slice")
+	}
+	if err := NewDecoder(strings.NewReader(`d1:ai1ee`)).DecodeToChan(make(chan int, 1)); err == nil {
+		t.Error("DecodeToChan accepted a dictionary")
+	}
+	if err := NewDecoder(strings.NewReader(`li1e3:fooe`)).DecodeToChan(make(chan int, 2)); err == nil {
+		t.Error("DecodeToChan accepted a string element for an int channel")
+	}
+}
+
+func TestRawMessage(t *testing.T) {
+	type value struct {
+		A RawMessage `bencode:"a"`
+		B int        `bencode:"b"`
+	}
+	const in = `d1:ad1:xli1eee1:bi2ee`
+	var v value
+	if err := Unmarshal([]byte(in), &v); err != nil {
+		t.Fatal(err)
+	}
+	if string(v.A) != `d1:xli1eee` || v.B != 2 {
+		t.Errorf("Unmarshal = %+v", v)
+	}
+
+	b, err := Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != in {
+		t.Errorf("Marshal = %#q, want %#q", b, in)
+	}
+
+	if _, err := Marshal(RawMessage(nil)); err == nil {
+		t.Error("Marshal of a nil RawMessage succeeded")
+	}
+	if _, err := Marshal(RawMessage(`i1`)); err == nil {
+		t.Error("Marshal of an invalid RawMessage succeeded")
+	}
+}
+
+func TestDecoderMaxListElements(t *testing.T) {
+	tests := []struct {
+		data string
+		ok   bool
+	}{
+		{`li1ei2ei3ee`, true},
+		{`li1ei2ei3ei4ee`, false},
+		{`lli1ei2ei3eeli4ei5ei6eee`, true},
+		{`lli1ei2ei3ei4eee`, false},
+	}
+	for _, tt := range tests {
+		for _, v := range []interface{}{new(interface{}), new([]interface{})} {
+			dec := NewDecoder(strings.NewReader(tt.data))
+			dec.SetMaxListElements(3)
+			if err := dec.Decode(v); (err == nil) != tt.ok {
+				t.Errorf("Decode(%#q, %T) = %v, want ok %v", tt.data, v, err, tt.ok)
+			}
+		}
+	}
+}
+
+func TestEachListElement(t *testing.T) {
+	var record struct {
+		Name string `bencode:"name"`
+		Size int    `bencode:"size"`
+	}
+
+	var names []string
+	var sizes []int
+	dec := NewDecoder(strings.NewReader(`ld4:name1:a4:sizei1eed4:name1:bee`))
+	err := dec.EachListElement(&record, func(i int) error {
+		if i != len(names) {
+			t.Errorf("element index = %d, want %d", i, len(names))
+		}
+		names = append(names, record.Name)
+		sizes = append(sizes, record.Size)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2 || names[0] != "a" || names[1] != "b" || sizes[0] != 1 || sizes[1] != 0 {
+		t.Errorf("EachListElement decoded names %v and sizes %v", names, sizes)
+	}
+
+	stop := errors.New("stop")
+	calls := 0
+	err = NewDecoder(strings.NewReader(`li1ei2ei3ee`)).EachListElement(new(int), func(int) error {
+		calls++
+		return stop
+	})
+	if err != stop || calls != 1 {
+		t.Errorf("EachListElement = %v after %d calls, want %v after 1", err, calls, stop)
+	}
+}
+
+func TestDecoderEOF(t *testing.T) {
+	dec := NewDecoder(strings.NewReader(`i1e`))
+	var n int
+	if err := dec.Decode(&n); err != nil || n != 1 {
+		t.Fatalf("Decode = %d, %v", n, err)
+	}
+	if err := dec.Decode(&n); err != io.EOF {
+		t.Errorf("Decode after the last value = %v, want io.EOF", err)
+	}
+
+	// Input ending inside a value is unexpected.
+	dec = NewDecoder(strings.NewReader(`i1ei2`))
+	if err := dec.Decode(&n); err != nil {
+		t.Fatal(err)
+	}
+	if err := dec.Decode(&n); err != io.ErrUnexpectedEOF {
+		t.Errorf("Decode of a truncated value = %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestEncoder(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	if err := enc.Encode(map[string]int{"b": 2, "a": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.WriteRaw(RawMessage(`l3:fooe`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.Encode("bar"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), `d1:ai1e1:bi2eel3:fooe3:bar`; got != want {
+		t.Errorf("Encoder wrote %#q, want %#q", got, want)
+	}
+}
+
+func TestEncoderWriteRaw(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	if err := enc.WriteRaw(RawMessage(`l3:foo`)); err == nil {
+		t.Error("WriteRaw accepted invalid bencode")
+	}
+	if buf.Len() != 0 {
+		t.Errorf("WriteRaw wrote %#q for invalid input", buf.Bytes())
+	}
+
+	enc.SetTrustRaw(true)
+	if err := enc.WriteRaw(RawMessage(`l3:foo`)); err != nil {
+		t.Errorf("trusted WriteRaw: %v", err)
+	}
+	if got := buf.String(); got != `l3:foo` {
+		t.Errorf("trusted WriteRaw wrote %#q", got)
+	}
+}
+
+// endlessReader returns an unlimited stream of 'a' bytes.
+type endlessReader struct{}
+
+func (endlessReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 'a'
+	}
+	return len(p), nil
+}
+
+func TestDecoderMaxStringLen(t *testing.T) {
+	dec := NewDecoder(io.MultiReader(strings.NewReader(`d4:name3:foo6:pieces99999999999999:`), endlessReader{}))
+	dec.SetMaxStringLen(1 << 20)
+
+	var v map[string]string
+	err := dec.Decode(&v)
+	if _, ok := err.(*SyntaxError); !ok {
+		t.Fatalf("Decode = %v, want *SyntaxError", err)
+	}
+
+	dec = NewDecoder(strings.NewReader(`d4:name3:fooe`))
+	dec.SetMaxStringLen(4)
+	if err := dec.Decode(&v); err != nil || v["name"] != "foo" {
+		t.Errorf("Decode = %v, %v", v, err)
+	}
+}
+
+func TestDecoderNameMapper(t *testing.T) {
+	var v struct {
+		Name   string
+		Length int    `bencode:"len"`
+		Legacy string `bencode:"x-legacy"`
+	}
+
+	dec := NewDecoder(strings.NewReader(`d3:leni3e8:x-legacy1:a10:x-old-name3:fooe`))
+	dec.SetNameMapper(func(key []byte) string {
+		return strings.TrimPrefix(strings.Replace(string(key), "old-", "", 1), "x-")
+	})
+	if err := dec.Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Name != "foo" || v.Length != 3 || v.Legacy != "a" {
+		t.Errorf("Decode = %+v", v)
+	}
+}
+
+func TestDecoderPreserveExistingSlices(t *testing.T) {
+	type config struct {
+		Trackers []string `bencode:"trackers"`
+		Ports    []int    `bencode:"ports"`
+	}
+
+	v := config{Trackers: []string{"default"}, Ports: []int{1}}
+	if err := NewDecoder(strings.NewReader(`d8:trackersl1:aee`)).Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	if len(v.Trackers) != 1 || v.Trackers[0] != "a" || len(v.Ports) != 1 {
+		t.Errorf("default Decode = %+v", v)
+	}
+
+	v = config{Trackers: []string{"default"}, Ports: []int{1}}
+	dec := NewDecoder(strings.NewReader(`d5:portsle8:trackersl1:a1:bee`))
+	dec.PreserveExistingSlices()
+	if err := dec.Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	if len(v.Trackers) != 3 || v.Trackers[0] != "default" || v.Trackers[2] != "b" || len(v.Ports) != 1 {
+		t.Errorf("PreserveExistingSlices Decode = %+v", v)
+	}
+}
+
+func TestDecodeTypeErrorOffset(t *testing.T) {
+	const first = `d1:ai1ee`
+	const second = `d1:bi2e1:a3:fooe`
+
+	var v struct {
+		A int `bencode:"a"`
+		B int `bencode:"b"`
+	}
+	dec := NewDecoder(strings.NewReader(first + second))
+	if err := dec.Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+
+	err := dec.Decode(&v)
+	te, ok := err.(*UnmarshalTypeError)
+	if !ok {
+		t.Fatalf("Decode = %v, want *UnmarshalTypeError", err)
+	}
+	start := int64(len(first) + strings.Index(second, "3:foo"))
+	if te.Offset < start || te.Offset > start+int64(len("3:foo")) {
+		t.Errorf("Offset = %d, want within the value at %d", te.Offset, start)
+	}
+}
+
+func TestDecoderStringsAsNumbers(t *testing.T) {
+	type peer struct {
+		Port     uint16 `bencode:"port"`
+		Interval int    `bencode:"interval"`
+		Name     string `bencode:"name"`
+	}
+
+	const data = `d8:intervali1800e4:name4:12344:port4:6881e`
+
+	var v peer
+	if err := NewDecoder(strings.NewReader(data)).Decode(&v); err == nil {
+		t.Error("Decode accepted a string for an integer field by default")
+	}
+
+	v = peer{}
+	dec := NewDecoder(strings.NewReader(data))
+	dec.StringsAsNumbers()
+	if err := dec.Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	if v != (peer{6881, 1800, "1234"}) {
+		t.Errorf("Decode = %+v", v)
+	}
+
+	for _, bad := range []string{`d4:port2:6xe`, `d4:port0:e`, `d4:port5:99999e`} {
+		dec := NewDecoder(strings.NewReader(bad))
+		dec.StringsAsNumbers()
+		if err := dec.Decode(&v); err == nil {
+			t.Errorf("Decode(%#q) succeeded", bad)
+		}
+	}
+}
+
+func TestDecoderIntegerMapValuesAsStrings(t *testing.T) {
+	const data = `d3:fooi42e3:negi-7e4:text2:hie`
+
+	var m map[string]string
+	if err := NewDecoder(strings.NewReader(data)).Decode(&m); err == nil {
+		t.Error("Decode accepted an integer for a string map value by default")
+	}
+
+	m = nil
+	dec := NewDecoder(strings.NewReader(data + `d1:ad1:bi1eee`))
+	dec.IntegerMapValuesAsStrings()
+	if err := dec.Decode(&m); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"foo": "42", "neg": "-7", "text": "hi"}; !reflect.DeepEqual(m, want) {
+		t.Errorf("Decode = %v, want %v", m, want)
+	}
+
+	// Only map values are affected, not struct fields.
+	var v struct {
+		A struct {
+			B string `bencode:"b"`
+		} `bencode:"a"`
+	}
+	if err := dec.Decode(&v); err == nil {
+		t.Errorf("Decode into a string field = %+v, want an error", v)
+	}
+}
+
+func TestDecoderMaxBufferGrowth(t *testing.T) {
+	const size = 1 << 20
+	data := strconv.Itoa(size) + ":" + strings.Repeat("x", size)
+
+	for _, tt := range []struct {
+		growth  int
+		maxWant int
+	}{
+		{0, 2 * size},
+		{4096, len(data) + 4096 + 512},
+	} {
+		dec := NewDecoder(strings.NewReader(data))
+		dec.SetMaxBufferGrowth(tt.growth)
+		var s string
+		if err := dec.Decode(&s); err != nil {
+			t.Fatal(err)
+		}
+		if len(s) != size {
+			t.Errorf("growth %d: decoded %d bytes, want %d", tt.growth, len(s), size)
+		}
+		if c := cap(dec.buf); c < len(data) || c > tt.maxWant {
+			t.Errorf("growth %d: buffer capacity %d, want %d to %d", tt.growth, c, len(data), tt.maxWant)
+		}
+	}
+}
+
+func TestDecoderMaxStringLenOffset(t *testing.T) {
+	const first = `d4:name3:fooe`
+	const second = `d4:name3:bar6:pieces12345:`
+
+	var v map[string]string
+	dec := NewDecoder(strings.NewReader(first + second))
+	dec.SetMaxStringLen(1000)
+	if err := dec.Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+
+	err := dec.Decode(&v)
+	se, ok := err.(*SyntaxError)
+	if !ok {
+		t.Fatalf("Decode = %v, want *SyntaxError", err)
+	}
+	if want := int64(len(first) + strings.Index(second, "12345")); se.Offset != want {
+		t.Errorf("Offset = %d, want %d", se.Offset, want)
+	}
+}
+
+// countingReader counts the calls to Read of the reader it wraps.
+type countingReader struct {
+	r     io.Reader
+	reads int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	r.reads++
+	return r.r.Read(p)
+}
+
+func TestDecoderBufferedValues(t *testing.T) {
+	r := &countingReader{r: bytes.NewReader([]byte(`i1e3:abcd1:ai2ee`))}
+	dec := NewDecoder(r)
+
+	want := []interface{}{int64(1), "abc", map[string]interface{}{"a": int64(2)}}
+	for i, w := range want {
+		var v interface{}
+		if err := dec.Decode(&v); err != nil {
+			t.Fatalf("Decode %d: %v", i, err)
+		}
+		if !reflect.DeepEqual(v, w) {
+			t.Errorf("Decode %d = %#v, want %#v", i, v, w)
+		}
+		if r.reads != 1 {
+			t.Errorf("Decode %d: %d reads, want 1", i, r.reads)
+		}
+	}
+
+	var v interface{}
+	if err := dec.Decode(&v); err != io.EOF {
+		t.Errorf("Decode after last value = %v, want io.EOF", err)
+	}
+}
+
+func TestEncoderKeyMapper(t *testing.T) {
+	type file struct {
+		PieceLength int
+		Name        string
+		Size        int    `bencode:"a"`
+		URL         string `bencode:"URL"`
+		Private     bool   `bencode:",omitempty"`
+	}
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.SetKeyMapper(strings.ToLower)
+	if err := enc.Encode(file{PieceLength: 16, Name: "x", Size: 1, URL: "u"}); err != nil {
+		t.Fatal(err)
+	}
+	// Mapped keys are sorted as mapped, and tags win over the mapper.
+	const want = `d3:URL1:u1:ai1e4:name1:x11:piecelengthi16ee`
+	if got := buf.String(); got != want {
+		t.Errorf("Encoder wrote %#q, want %#q", got, want)
+	}
+
+	type clash struct {
+		Name string
+		NAME string
+	}
+	if err := enc.Encode(clash{}); err == nil {
+		t.Error("Encode of clashing mapped keys succeeded")
+	}
+
+	// The mapped keys of a struct type are computed once per Encoder.
+	calls := 0
+	enc.SetKeyMapper(func(name string) string {
+		calls++
+		return strings.ToLower(name)
+	})
+	if err := enc.Encode(make([]file, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.Encode(file{}); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 3 {
+		t.Errorf("key mapper called %d times, want 3", calls)
+	}
+}
+
+func TestEncoderFieldOrder(t *testing.T) {
+	type response struct {
+		Interval int    `bencode:"interval"`
+		Peers    string `bencode:"peers"`
+		Complete int    `bencode:"complete"`
+		Warning  string `bencode:"warning message,omitempty"`
+	}
+	v := response{Interval: 1800, Peers: "p", Complete: 3}
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.SetFieldOrder(reflect.TypeOf(&v), []string{"peers", "warning message", "interval", "unknown"})
+	if err := enc.Encode(v); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), `d5:peers1:p8:intervali1800e8:completei3ee`; got != want {
+		t.Errorf("Encoder wrote %#q, want %#q", got, want)
+	}
+
+	// Nested values of other types are still sorted.
+	buf.Reset()
+	if err := enc.Encode(map[string]response{"b": v, "a": v}); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); !strings.HasPrefix(got, `d1:ad5:peers`) {
+		t.Errorf("Encoder wrote %#q", got)
+	}
+
+	buf.Reset()
+	enc.SetFieldOrder(reflect.TypeOf(v), nil)
+	if err := enc.Encode(v); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), `d8:completei3e8:intervali1800e5:peers1:pe`; got != want {
+		t.Errorf("Encoder wrote %#q after resetting the order, want %#q", got, want)
+	}
+}
+
+type logLevel int
+
+func (l logLevel) String() string { return [...]string{"debug", "info"}[l] }
+
+type counter struct{ n int }
+
+func (c *counter) String() string { return strconv.Itoa(c.n) + " calls" }
+
+func TestEncoderUseStringer(t *testing.T) {
+	type entry struct {
+		Level logLevel `bencode:"level"`
+		Calls counter  `bencode:"calls"`
+		Err   error    `bencode:"err"`
+		Peer  net.IP   `bencode:"peer"`
+		Count Number   `bencode:"count"`
+	}
+	v := entry{Level: 1, Calls: counter{3}, Err: errors.New("timeout"), Peer: net.IPv4(10, 0, 0, 1), Count: "7"}
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.UseStringer(true)
+	if err := enc.Encode(&v); err != nil {
+		t.Fatal(err)
+	}
+	const want = `d5:calls7:3 calls5:counti7e3:err7:timeout5:level4:info4:peer8:10.0.0.1e`
+	if got := buf.String(); got != want {
+		t.Errorf("Encoder wrote %#q, want %#q", got, want)
+	}
+
+	// Pointer receivers need an addressable value.
+	buf.Reset()
+	if err := enc.Encode(struct{ C counter }{counter{3}}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), `d1:Cdee`; got != want {
+		t.Errorf("Encoder wrote %#q, want %#q", got, want)
+	}
+
+	// A nil error in a list is an error, not a missing element.
+	buf.Reset()
+	if err := enc.Encode([]error{nil, errors.New("x")}); err == nil {
+		t.Errorf("Encode of a nil error in a list succeeded: %#q", buf.String())
+	}
+
+	// Without UseStringer, String and Error are ignored, but MarshalText
+	// is still used, so the value decodes back through UnmarshalText.
+	type plain struct {
+		Level logLevel
+		IP    netip.Addr
+		Peer  net.IP
+	}
+	in := plain{1, netip.MustParseAddr("10.0.0.2"), net.IPv4(10, 0, 0, 1)}
+	got, err := Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `d2:IP8:10.0.0.25:Leveli1e4:Peer8:10.0.0.1e`; string(got) != want {
+		t.Errorf("Marshal = %#q, want %#q", got, want)
+	}
+	var out plain
+	if err := Unmarshal(got, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Level != in.Level || out.IP != in.IP || !out.Peer.Equal(in.Peer) {
+		t.Errorf("Unmarshal = %+v, want %+v", out, in)
+	}
+
+}
+
+func TestStreamEncoder(t *testing.T) {
+	var buf bytes.Buffer
+	s := NewStreamEncoder(&buf)
+
+	steps := []func() error{
+		s.BeginDict,
+		func() error { return s.Key("announce") },
+		func() error { return s.Value("http://tracker/ann") },
+		func() error { return s.Key("info") },
+		s.BeginDict,
+		func() error { return s.Key("length") },
+		func() error { return s.Value(3) },
+		func() error { return s.Key("name") },
+		func() error { return s.Value([]byte("a")) },
+		func() error { return s.Key("pieces") },
+		func() error { return s.Value([]byte(strings.Repeat("x", 20))) },
+		s.EndDict,
+		s.EndDict,
+	}
+	for i, step := range steps {
+		if err := step(); err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+	}
+
+	const want = `d8:announce18:http://tracker/ann4:infod6:lengthi3e4:name1:a6:pieces20:xxxxxxxxxxxxxxxxxxxxee`
+	if buf.String() != want {
+		t.Errorf("StreamEncoder wrote %#q, want %#q", buf.String(), want)
+	}
+}
+
+func TestStreamEncoderErrors(t *testing.T) {
+	s := NewStreamEncoder(new(bytes.Buffer))
+	if err := s.Key("a"); err == nil {
+		t.Error("Key outside of a dictionary succeeded")
+	}
+	if err := s.EndDict(); err == nil {
+		t.Error("EndDict without BeginDict succeeded")
+	}
+
+	s.BeginDict()
+	if err := s.Value(1); err == nil {
+		t.Error("Value without a key succeeded")
+	}
+	s.Key("b")
+	if err := s.Key("c"); err == nil {
+		t.Error("Key before value succeeded")
+	}
+	if err := s.EndDict(); err == nil {
+		t.Error("EndDict before value succeeded")
+	}
+	s.Value(1)
+	if err := s.Key("a"); err == nil {
+		t.Error("unsorted Key succeeded")
+	}
+	if err := s.Key("b"); err == nil {
+		t.Error("duplicate Key succeeded")
+	}
+}
+
+func TestDecode(t *testing.T) {
+	var v map[string]int
+	if err := Decode(strings.NewReader(`d1:ai1ee`), &v); err != nil || v["a"] != 1 {
+		t.Errorf("Decode = %v, %v", v, err)
+	}
+
+	err := Decode(io.MultiReader(strings.NewReader(`i1e`), strings.NewReader(`i2e`)), new(int))
+	if se, ok := err.(*SyntaxError); !ok || se.Offset != 3 {
+		t.Errorf("Decode with trailing data = %v, want SyntaxError at offset 3", err)
+	}
+
+	if err := Decode(strings.NewReader(`i1`), new(int)); err != io.ErrUnexpectedEOF {
+		t.Errorf("Decode of truncated value = %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestDecoderMaxIntegerDigits(t *testing.T) {
+	dec := NewDecoder(strings.NewReader(`i12345ei-12345eli123456ee`))
+	dec.SetMaxIntegerDigits(5)
+
+	var n int64
+	if err := dec.Decode(&n); err != nil || n != 12345 {
+		t.Errorf("Decode = %d, %v", n, err)
+	}
+	if err := dec.Decode(&n); err != nil || n != -12345 {
+		t.Errorf("Decode = %d, %v", n, err)
+	}
+	var list []int64
+	err := dec.Decode(&list)
+	if se, ok := err.(*SyntaxError); !ok || se.Offset != 16 {
+		t.Errorf("Decode of 6-digit integer = %v, want SyntaxError at offset 16", err)
+	}
+
+	r := &countingReader{r: strings.NewReader("i" + strings.Repeat("9", 1<<20) + "e")}
+	dec = NewDecoder(r)
+	dec.SetMaxIntegerDigits(20)
+	if err := dec.Decode(new(RawMessage)); err == nil {
+		t.Error("Decode of huge integer succeeded")
+	}
+	if r.reads != 1 {
+		t.Errorf("Decode of huge integer read %d times, want 1", r.reads)
+	}
+}
+
+func TestDecoderResync(t *testing.T) {
+	dec := NewDecoder(strings.NewReader(`i1ei-0ei2ed1:a?ei3e3:abc`))
+
+	var got []interface{}
+	for {
+		var v interface{}
+		err := dec.Decode(&v)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if _, ok := err.(*SyntaxError); !ok {
+				t.Fatalf("Decode = %v, want *SyntaxError", err)
+			}
+			if err := dec.Resync(); err != nil {
+				t.Fatalf("Resync = %v", err)
+			}
+			continue
+		}
+		got = append(got, v)
+	}
+
+	want := []interface{}{int64(1), int64(2), int64(3), "abc"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("decoded %v, want %v", got, want)
+	}
+
+	dec = NewDecoder(strings.NewReader(`i1`))
+	if err := dec.Decode(new(int)); err != io.ErrUnexpectedEOF {
+		t.Fatalf("Decode = %v, want io.ErrUnexpectedEOF", err)
+	}
+	if err := dec.Resync(); err != io.ErrUnexpectedEOF {
+		t.Errorf("Resync after read error = %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestDecoderDecodeKeys(t *testing.T) {
+	var tor Torrent
+	dec := NewDecoder(strings.NewReader(multiFile + multiFile))
+	if err := dec.DecodeKeys(&tor, "announce", "comment"); err != nil {
+		t.Fatal(err)
+	}
+	if tor.Announce != "http://tracker/ann" || tor.AnnounceList != nil || tor.Info.Name != "" {
+		t.Errorf("DecodeKeys(announce, comment) = %+v", tor)
+	}
+
+	var m map[string]interface{}
+	if err := dec.DecodeKeys(&m, "info"); err != nil {
+		t.Fatal(err)
+	}
+	info, ok := m["info"].(map[string]interface{})
+	if len(m) != 1 || !ok || info["name"] != "dir" || len(info["files"].([]interface{})) != 2 {
+		t.Errorf("DecodeKeys(info) = %v", m)
+	}
+
+	// Skipped keys count as absent: defaults apply to them, required
+	// fields among them are missing, and embedded pointers stay nil.
+	type Extra struct {
+		D int `bencode:"d"`
+	}
+	type keys struct {
+		A int `bencode:"a,required"`
+		B int `bencode:"b,default=7"`
+		C int `bencode:"c"`
+		*Extra
+	}
+	const in = `d1:ai1e1:bi2e1:ci3e1:di4ee`
+	var v keys
+	err := NewDecoder(strings.NewReader(in)).DecodeKeys(&v, "c")
+	if err == nil || !strings.Contains(err.Error(), `missing required field "a"`) {
+		t.Errorf("DecodeKeys(c) error = %v, want missing required field a", err)
+	}
+	if v.A != 0 || v.B != 7 || v.C != 3 || v.Extra != nil {
+		t.Errorf("DecodeKeys(c) = %+v", v)
+	}
+
+	v = keys{}
+	if err := NewDecoder(strings.NewReader(in)).DecodeKeys(&v, "a", "d"); err != nil {
+		t.Fatal(err)
+	}
+	if v.A != 1 || v.B != 7 || v.C != 0 || v.Extra == nil || v.D != 4 {
+		t.Errorf("DecodeKeys(a, d) = %+v", v)
+	}
+}
+
+func TestDecoderMaxInterfaceNodes(t *testing.T) {
+	// 1 map, 1 list, 3 strings and 1 integer.
+	const small = `d1:al1:b1:ci1eee`
+	dec := NewDecoder(strings.NewReader(small + small))
+	dec.SetMaxInterfaceNodes(6)
+	for i := 0; i < 2; i++ {
+		var v interface{}
+		if err := dec.Decode(&v); err != nil {
+			t.Fatalf("Decode %d: %v", i, err)
+		}
+	}
+
+	nested := strings.Repeat("l", 1000) + strings.Repeat("e", 1000)
+	dec = NewDecoder(strings.NewReader(nested))
+	dec.SetMaxInterfaceNodes(100)
+	var v interface{}
+	if err := dec.Decode(&v); !errors.Is(err, ErrTooManyInterfaceNodes) {
+		t.Errorf("Decode of 1000 nested lists = %v, want ErrTooManyInterfaceNodes", err)
+	}
+	if err := UnmarshalMaxInterfaceNodes([]byte(nested), &v, 100); !errors.Is(err, ErrTooManyInterfaceNodes) {
+		t.Errorf("UnmarshalMaxInterfaceNodes of 1000 nested lists = %v, want ErrTooManyInterfaceNodes", err)
+	}
+	if err := UnmarshalMaxInterfaceNodes([]byte(small), &v, 6); err != nil {
+		t.Errorf("UnmarshalMaxInterfaceNodes within the limit: %v", err)
+	}
+
+	// Only nodes created for interface values count.
+	dec = NewDecoder(strings.NewReader(`d1:ali1ei2ei3ee1:bl1:xee`))
+	dec.SetMaxInterfaceNodes(2)
+	var s struct {
+		A []int       `bencode:"a"`
+		B interface{} `bencode:"b"`
+	}
+	if err := dec.Decode(&s); err != nil {
+		t.Errorf("Decode into struct: %v", err)
+	}
+}
+
+func TestDecoderDecodeInto(t *testing.T) {
+	type limits struct {
+		Up   int `bencode:"up"`
+		Down int `bencode:"down"`
+	}
+	type settings struct {
+		Name   string `bencode:"name"`
+		Port   int    `bencode:"port"`
+		Limits limits `bencode:"limits"`
+	}
+
+	s := settings{Name: "node", Port: 6881, Limits: limits{Up: 10, Down: 20}}
+	dec := NewDecoder(strings.NewReader(`d6:limitsd2:upi0ee4:porti6882eed4:name3:newe`))
+
+	updated, err := dec.DecodeInto(&s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := settings{Name: "node", Port: 6882, Limits: limits{Up: 0, Down: 20}}
+	if s != want {
+		t.Errorf("DecodeInto = %+v, want %+v", s, want)
+	}
+	if wantUpdated := []string{"limits", "limits.up", "port"}; !reflect.DeepEqual(updated, wantUpdated) {
+		t.Errorf("updated = %q, want %q", updated, wantUpdated)
+	}
+
+	updated, err = dec.DecodeInto(&s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Name != "new" || !reflect.DeepEqual(updated, []string{"name"}) {
+		t.Errorf("second DecodeInto = %+v, updated %q", s, updated)
+	}
+}
+
+// stringData returns the address of the bytes of s.
+func stringData(s string) uintptr {
+	return (*reflect.StringHeader)(unsafe.Pointer(&s)).Data
+}
+
+func TestDecoderInternKeys(t *testing.T) {
+	dec := NewDecoder(strings.NewReader(`d4:named4:name1:aee` + `d4:name1:be`))
+	dec.InternKeys()
+
+	var keys []string
+	for i := 0; i < 2; i++ {
+		var m map[string]interface{}
+		if err := dec.Decode(&m); err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range m {
+			keys = append(keys, k)
+			if inner, ok := v.(map[string]interface{}); ok {
+				for k := range inner {
+					keys = append(keys, k)
+				}
+			}
+		}
+	}
+	if len(keys) != 3 {
+		t.Fatalf("decoded keys %q, want 3 names", keys)
+	}
+	for _, k := range keys[1:] {
+		if k != "name" || stringData(k) != stringData(keys[0]) {
+			t.Errorf("key %q does not share the memory of %q", k, keys[0])
+		}
+	}
+}
+
+func TestDecoderRawField(t *testing.T) {
+	type info struct {
+		Name   string     `bencode:"name"`
+		Length int64      `bencode:"length"`
+		Raw    RawMessage `bencode:",raw"`
+	}
+	type torrent struct {
+		Info info `bencode:"info"`
+	}
+
+	const first, second = `d6:lengthi5e4:name1:ae`, `d6:lengthi7e4:name1:be`
+	dec := NewDecoder(strings.NewReader(`d4:info` + first + `e` + `d4:info` + second + `e`))
+	var a, b torrent
+	if err := dec.Decode(&a); err != nil {
+		t.Fatal(err)
+	}
+	if err := dec.Decode(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	// The raw bytes of the first value must not change while decoding
+	// the second, and hash like the original info dictionary.
+	if a.Info.Name != "a" || a.Info.Length != 5 || string(a.Info.Raw) != first {
+		t.Errorf("first = %+v", a.Info)
+	}
+	if b.Info.Name != "b" || b.Info.Length != 7 || string(b.Info.Raw) != second {
+		t.Errorf("second = %+v", b.Info)
+	}
+	if sha1.Sum(a.Info.Raw) != sha1.Sum([]byte(first)) {
+		t.Error("hash of raw info differs from hash of the input")
+	}
+}
+
+func TestDecoderStringSink(t *testing.T) {
+	const size = 4 << 20
+	pieces := strings.Repeat("x", size)
+	type info struct {
+		Length int        `bencode:"length"`
+		Name   int        `bencode:"name"`
+		Pieces StringSink `bencode:"pieces"`
+	}
+	type torrent struct {
+		Info *info `bencode:"info"`
+	}
+
+	in := `d4:infod6:lengthi3e4:name1:a6:pieces` + strconv.Itoa(size) + ":" + pieces + `ee` + `d4:infod6:pieces0:ee`
+	dec := NewDecoder(strings.NewReader(in))
+	h := sha1.New()
+	v := torrent{Info: &info{Pieces: StringSink{W: h}}}
+	err := dec.Decode(&v)
+	if te, ok := err.(*UnmarshalTypeError); !ok || te.Field != "name" || te.Offset != 28 {
+		t.Errorf("Decode error = %#v, want UnmarshalTypeError for name at offset 28", err)
+	}
+	if want := sha1.Sum([]byte(pieces)); !bytes.Equal(h.Sum(nil), want[:]) {
+		t.Errorf("sink received data hashing to %x", h.Sum(nil))
+	}
+	if v.Info.Length != 3 {
+		t.Errorf("Length = %d, want 3", v.Info.Length)
+	}
+	// The string went through the buffer in chunks instead of filling it.
+	if c := cap(dec.buf); c > 64<<10 {
+		t.Errorf("buffer capacity %d after streaming %d bytes", c, size)
+	}
+
+	if err := dec.Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	if err := dec.Decode(&v); err != io.EOF {
+		t.Errorf("Decode at end of input = %v, want io.EOF", err)
+	}
+
+	dec = NewDecoder(strings.NewReader(`d4:infod6:pieces10:abc`))
+	if err := dec.Decode(&v); err != io.ErrUnexpectedEOF {
+		t.Errorf("Decode of truncated string = %v, want io.ErrUnexpectedEOF", err)
+	}
+	dec = NewDecoder(strings.NewReader(`d4:infod6:piecesi1ee`))
+	if err := dec.Decode(&torrent{}); err == nil {
+		t.Error("Decode of an integer into a StringSink succeeded")
+	}
+}
+
+func TestDecoderInfoHash(t *testing.T) {
+	pieces := strings.Repeat("0123456789abcdefghij", 200)
+	info := `d6:lengthi5e4:name1:a12:piece lengthi16384e6:pieces` + strconv.Itoa(len(pieces)) + ":" + pieces + `e`
+	torrent := `d8:announce3:url4:info` + info + `4:infx0:e`
+
+	dec := NewDecoder(iotest.OneByteReader(strings.NewReader(torrent + torrent + `d4:infoi1ee` + `de`)))
+	sum, err := dec.InfoHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum != sha1.Sum([]byte(info)) {
+		t.Errorf("InfoHash = %x, want %x", sum, sha1.Sum([]byte(info)))
+	}
+	if cap(dec.buf) >= len(torrent) {
+		t.Errorf("InfoHash buffered %d bytes of a %d byte torrent", cap(dec.buf), len(torrent))
+	}
+	sum2, err := dec.InfoHashV2()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum2 != sha256.Sum256([]byte(info)) {
+		t.Errorf("InfoHashV2 = %x, want %x", sum2, sha256.Sum256([]byte(info)))
+	}
+
+	// Any value of the info key is hashed, but one is required.
+	if sum, err := dec.InfoHash(); err != nil || sum != sha1.Sum([]byte(`i1e`)) {
+		t.Errorf("InfoHash of an integer = %x, %v", sum, err)
+	}
+	if _, err := dec.InfoHash(); err == nil {
+		t.Error("InfoHash of a torrent without info succeeded")
+	}
+	if _, err := dec.InfoHash(); err != io.EOF {
+		t.Errorf("InfoHash at end of input = %v, want io.EOF", err)
+	}
+
+	p, err := ParseTorrent([]byte(multiFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum, err := NewDecoder(strings.NewReader(multiFile)).InfoHash(); err != nil || sum != p.InfoHash {
+		t.Errorf("InfoHash = %x, %v; want %x from ParseTorrent", sum, err, p.InfoHash)
+	}
+
+	for _, bad := range []string{`l4:infoe`, `d4:infode4:infodee`, `d4:infod`} {
+		if _, err := NewDecoder(strings.NewReader(bad)).InfoHash(); err == nil {
+			t.Errorf("InfoHash(%#q) succeeded", bad)
+		}
+	}
+}
+
+func TestDecoderToken(t *testing.T) {
+	dec := NewDecoder(strings.NewReader(`d1:ai-1e1:bl1:xdeee` + `i2e`))
+	var got []Token
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, tok)
+	}
+	want := []Token{Delim('d'), "a", int64(-1), "b", Delim('l'), "x", Delim('d'), Delim('e'), Delim('e'), Delim('e'), int64(2)}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Token = %v, want %v", got, want)
+	}
+
+	for _, bad := range []string{`e`, `di1ei2ee`, `dle`, `d1:ae`, `ld1:aee`} {
+		dec := NewDecoder(strings.NewReader(bad))
+		var err error
+		for err == nil {
+			_, err = dec.Token()
+		}
+		if _, ok := err.(*SyntaxError); !ok {
+			t.Errorf("Token(%#q) = %v, want *SyntaxError", bad, err)
+		}
+	}
+}
+
+// TestDecoderTokenTagged decodes lists of a type and a payload whose Go type
+// depends on it, peeking at the type with Token and decoding the payload.
+func TestDecoderTokenTagged(t *testing.T) {
+	type ping struct {
+		Seq int `bencode:"seq"`
+	}
+	type peer struct {
+		Port uint16 `bencode:"port"`
+	}
+
+	dec := NewDecoder(strings.NewReader(`l4:pingd3:seqi7ee` + `e` + `l4:peerd4:porti6881eee`))
+	var got []interface{}
+	for dec.More() {
+		if tok, err := dec.Token(); err != nil || tok != Delim('l') {
+			t.Fatalf("Token = %v, %v; want l", tok, err)
+		}
+		tag, err := dec.Token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var payload interface{}
+		switch tag {
+		case "ping":
+			payload = new(ping)
+		case "peer":
+			payload = new(peer)
+		default:
+			t.Fatalf("unknown tag %v", tag)
+		}
+		if err := dec.Decode(payload); err != nil {
+			t.Fatal(err)
+		}
+		if tok, err := dec.Token(); err != nil || tok != Delim('e') {
+			t.Fatalf("Token = %v, %v; want e", tok, err)
+		}
+		got = append(got, payload)
+	}
+	if want := []interface{}{&ping{7}, &peer{6881}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("decoded %+v, want %+v", got, want)
+	}
+}
+
+func TestCopyValue(t *testing.T) {
+	big := `d6:pieces10000:` + strings.Repeat("x", 10000) + `e`
+	for _, value := range []string{`i1e`, `0:`, `d1:ali1e1:bee`, big} {
+		src := bufio.NewReader(strings.NewReader(value + `i2e`))
+		var dst bytes.Buffer
+		n, err := CopyValue(&dst, src)
+		if err != nil || n != int64(len(value)) || dst.String() != value {
+			t.Errorf("CopyValue(%.20q) = %d, %v, copied %.20q", value, n, err, dst.String())
+			continue
+		}
+		rest, _ := ioutil.ReadAll(src)
+		if string(rest) != `i2e` {
+			t.Errorf("CopyValue(%.20q) left %q in src", value, rest)
+		}
+	}
+
+	for _, tt := range []struct {
+		src string
+		err error
+	}{
+		{``, io.EOF},
+		{`d1:a`, io.ErrUnexpectedEOF},
+		{`d1:ax`, nil},
+	} {
+		_, err := CopyValue(ioutil.Discard, strings.NewReader(tt.src))
+		if tt.err != nil && err != tt.err {
+			t.Errorf("CopyValue(%#q) = %v, want %v", tt.src, err, tt.err)
+		}
+		if _, ok := err.(*SyntaxError); tt.err == nil && !ok {
+			t.Errorf("CopyValue(%#q) = %v, want *SyntaxError", tt.src, err)
+		}
+	}
+}
+
+func TestDecoderRequireFieldMatch(t *testing.T) {
+	type unexported struct {
+		name   string
+		length int
+	}
+	type partial struct {
+		Name string `bencode:"name"`
+	}
+
+	const data = `d6:lengthi1e4:name1:ae`
+	var u unexported
+	if err := NewDecoder(strings.NewReader(data)).Decode(&u); err != nil {
+		t.Errorf("Decode without RequireFieldMatch: %v", err)
+	}
+
+	dec := NewDecoder(strings.NewReader(data + data + `de`))
+	dec.RequireFieldMatch()
+	if err := dec.Decode(&u); err == nil {
+		t.Errorf("Decode into %T = %v, want an error", u, err)
+	}
+	var p partial
+	if err := dec.Decode(&p); err != nil || p.Name != "a" {
+		t.Errorf("Decode into %T = %+v, %v", p, p, err)
+	}
+	if err := dec.Decode(&u); err != nil {
+		t.Errorf("Decode of an empty dictionary into %T: %v", u, err)
+	}
+}
+
+func TestDecoderUseNumberText(t *testing.T) {
+	for _, text := range []string{
+		"0",
+		"5",
+		"-5",
+		"9223372036854775807",
+		"-9223372036854775808",
+		"123456789012345678901234567890",
+		"-123456789012345678901234567890",
+	} {
+		data := "li" + text + "ed1:ni" + text + "eee"
+		dec := NewDecoder(strings.NewReader(data))
+		dec.UseNumber()
+		var v []interface{}
+		if err := dec.Decode(&v); err != nil {
+			t.Errorf("Decode(%#q): %v", data, err)
+			continue
+		}
+		if n, ok := v[0].(Number); !ok || string(n) != text {
+			t.Errorf("Decode(%#q) list element = %#v, want Number(%q)", data, v[0], text)
+		}
+		if n, ok := v[1].(map[string]interface{})["n"].(Number); !ok || string(n) != text {
+			t.Errorf("Decode(%#q) dictionary value = %#v, want Number(%q)", data, v[1], text)
+		}
+
+		var s struct {
+			N Number `bencode:"n"`
+		}
+		if err := Unmarshal([]byte("d1:ni"+text+"ee"), &s); err != nil || string(s.N) != text {
+			t.Errorf("Unmarshal into a Number field = %q, %v; want %q", s.N, err, text)
+		}
+	}
+}
+
+func TestDecoderUseNumberList(t *testing.T) {
+	const data = `li1ei2ee`
+	want := []interface{}{Number("1"), Number("2")}
+
+	reused := make([]interface{}, 1, 4)
+	reused[0] = "old"
+	for _, tt := range []struct {
+		name string
+		v    interface{}
+	}{
+		{"[]interface{}", new([]interface{})},
+		{"interface{}", new(interface{})},
+		{"reused []interface{}", &reused},
+	} {
+		dec := NewDecoder(strings.NewReader(data))
+		dec.UseNumber()
+		if err := dec.Decode(tt.v); err != nil {
+			t.Errorf("Decode into %s: %v", tt.name, err)
+			continue
+		}
+		got := reflect.ValueOf(tt.v).Elem().Interface()
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Decode into %s = %#v, want %#v", tt.name, got, want)
+		}
+
+		// Numbers encode as the integers they were decoded from.
+		if b, err := Marshal(got); err != nil || string(b) != data {
+			t.Errorf("Marshal of %s = %q, %v; want %q", tt.name, b, err, data)
+		}
+	}
+
+	dec := NewDecoder(strings.NewReader(`lli1eei2ee`))
+	dec.UseNumber()
+	var nested []interface{}
+	if err := dec.Decode(&nested); err != nil {
+		t.Fatal(err)
+	}
+	if want := []interface{}{[]interface{}{Number("1")}, Number("2")}; !reflect.DeepEqual(nested, want) {
+		t.Errorf("Decode of nested lists = %#v, want %#v", nested, want)
+	}
+
+	var plain []interface{}
+	if err := Unmarshal([]byte(data), &plain); err != nil || !reflect.DeepEqual(plain, []interface{}{int64(1), int64(2)}) {
+		t.Errorf("Unmarshal without UseNumber = %#v, %v; want int64 elements", plain, err)
+	}
+}
+
+// failingReader returns its data and then err.
+type failingReader struct {
+	data string
+	err  error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.data == "" {
+		return 0, r.err
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestDecoderReadAll(t *testing.T) {
+	data := multiFile + `i1e` + singleFile
+	for _, r := range []io.Reader{strings.NewReader(data), iotest.HalfReader(strings.NewReader(data))} {
+		dec := NewDecoder(r)
+		dec.ReadAll()
+		if len(dec.buf) != len(data) {
+			t.Errorf("ReadAll buffered %d bytes, want %d", len(dec.buf), len(data))
+		}
+		var tor Torrent
+		var n int
+		if err := dec.Decode(&tor); err != nil || tor.Info.Name != "dir" {
+			t.Errorf("first Decode = %+v, %v", tor, err)
+		}
+		if err := dec.Decode(&n); err != nil || n != 1 {
+			t.Errorf("second Decode = %d, %v", n, err)
+		}
+		if err := dec.Decode(&tor); err != nil || tor.Info.Name != "file.bin" {
+			t.Errorf("third Decode = %+v, %v", tor, err)
+		}
+		if err := dec.Decode(&n); err != io.EOF {
+			t.Errorf("Decode at end of input = %v, want io.EOF", err)
+		}
+	}
+
+	fail := errors.New("connection reset")
+	dec := NewDecoder(&failingReader{`i1ei2`, fail})
+	dec.ReadAll()
+	var n int
+	if err := dec.Decode(&n); err != nil || n != 1 {
+		t.Errorf("Decode = %d, %v", n, err)
+	}
+	if err := dec.Decode(&n); err != fail {
+		t.Errorf("Decode of incomplete value = %v, want %v", err, fail)
+	}
+}
+
+func TestDecoderFailFast(t *testing.T) {
+	type message struct {
+		A int                 `bencode:"a"`
+		B countingUnmarshaler `bencode:"b"`
+	}
+	const bad, good = `d1:a1:x1:bi1ee`, `d1:ai2e1:bi3ee`
+
+	for _, failFast := range []bool{false, true} {
+		dec := NewDecoder(strings.NewReader(bad + good))
+		if failFast {
+			dec.FailFast()
+		}
+		var m message
+		err := dec.Decode(&m)
+		if ute, ok := err.(*UnmarshalTypeError); !ok || ute.Field != "a" || ute.Offset != 7 {
+			t.Errorf("FailFast %v: Decode = %v, want *UnmarshalTypeError for a at offset 7", failFast, err)
+		}
+		if calls := len(m.B.raw); failFast && calls != 0 || !failFast && calls != 1 {
+			t.Errorf("FailFast %v: b decoded %d times after the error", failFast, calls)
+		}
+
+		m = message{}
+		if err := dec.Decode(&m); err != nil || m.A != 2 || len(m.B.raw) != 1 {
+			t.Errorf("FailFast %v: next Decode = %+v, %v", failFast, m, err)
+		}
+	}
+
+	dec := NewDecoder(strings.NewReader(`li1e1:xi3ee`))
+	dec.FailFast()
+	var got []int
+	err := dec.EachListElement(new(int), func(i int) error {
+		got = append(got, i)
+		return nil
+	})
+	if _, ok := err.(*UnmarshalTypeError); !ok || len(got) != 1 {
+		t.Errorf("EachListElement = %v after %v, want *UnmarshalTypeError after [0]", err, got)
+	}
+}
+
+// prefixCheckReader fails unless w already holds prefix when it is first
+// read from.
+type prefixCheckReader struct {
+	r      io.Reader
+	w      *bytes.Buffer
+	prefix string
+	t      *testing.T
+}
+
+func (p *prefixCheckReader) Read(b []byte) (int, error) {
+	if p.prefix != "" {
+		if got := p.w.String(); got != p.prefix {
+			p.t.Errorf("writer holds %q before the first read, want %q", got, p.prefix)
+		}
+		p.prefix = ""
+	}
+	return p.r.Read(b)
+}
+
+func TestEncoderStringReader(t *testing.T) {
+	type info struct {
+		Name   string       `bencode:"name"`
+		Pieces StringReader `bencode:"pieces"`
+		Size   int          `bencode:"size"`
+	}
+	const want = "d4:name1:a6:pieces6:abcdef4:sizei3ee"
+
+	var buf bytes.Buffer
+	r := &prefixCheckReader{r: strings.NewReader("abcdefgh"), w: &buf, prefix: "d4:name1:a6:pieces6:", t: t}
+	if err := NewEncoder(&buf).Encode(info{"a", StringReader{R: r, N: 6}, 3}); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != want {
+		t.Errorf("Encoder wrote %q, want %q", buf.String(), want)
+	}
+
+	buf.Reset()
+	s := NewStreamEncoder(&buf)
+	if err := s.Value(&info{"a", StringReader{R: strings.NewReader("abcdef"), N: 6}, 3}); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != want {
+		t.Errorf("StreamEncoder wrote %q, want %q", buf.String(), want)
+	}
+
+	b, err := Marshal(info{"a", StringReader{R: strings.NewReader("abcdef"), N: 6}, 3})
+	if err != nil || string(b) != want {
+		t.Errorf("Marshal = %q, %v; want %q", b, err, want)
+	}
+
+	n, err := MarshalSize(info{"a", StringReader{R: errReader{errors.New("read")}, N: 6}, 3})
+	if err != nil || n != len(want) {
+		t.Errorf("MarshalSize = %d, %v; want %d", n, err, len(want))
+	}
+
+	// A short reader fails the Encoder, as part of the value is written.
+	buf.Reset()
+	enc := NewEncoder(&buf)
+	if err := enc.Encode(info{"a", StringReader{R: strings.NewReader("abc"), N: 6}, 3}); err == nil || !strings.Contains(err.Error(), "3 of 6") {
+		t.Errorf("Encode with a short reader = %v", err)
+	}
+	if err := enc.Encode(1); err == nil {
+		t.Error("Encode after a partial write succeeded")
+	}
+
+	for _, sr := range []StringReader{{N: 1}, {R: strings.NewReader(""), N: -1}} {
+		if _, err := Marshal(sr); err == nil {
+			t.Errorf("Marshal(%+v) succeeded", sr)
+		}
+	}
+}
@@ -31,3 +31,22 @@ func (o tagOptions) Contains(optionName string) bool {
 	}
 	return false
 }
+
+// Value returns the value of the option written as optionName=value, and
+// whether there is such an option. As options are separated by commas, the
+// value cannot contain one.
+func (o tagOptions) Value(optionName string) (string, bool) {
+	s := string(o)
+	for s != "" {
+		var next string
+		i := strings.Index(s, ",")
+		if i >= 0 {
+			s, next = s[:i], s[i+1:]
+		}
+		if strings.HasPrefix(s, optionName+"=") {
+			return s[len(optionName)+1:], true
+		}
+		s = next
+	}
+	return "", false
+}
@@ -0,0 +1,193 @@
+#!/usr/bin/env python3
+"""Generates the golden files in this directory.
+
+From every NAME.torrent it derives the files the round-trip test compares
+against:
+
+  NAME.canonical  the value re-encoded with dictionary keys sorted as raw
+                  byte strings
+  NAME.infohash   the hex SHA-1 of the info dictionary exactly as it appears
+                  in the input, if there is one
+
+and it checks that every NAME.invalid is rejected.
+
+Decoding and encoding are done by an established bencode implementation,
+the first of these that is installed:
+
+  libtorrent   the Python bindings of libtorrent-rasterbar (bdecode, bencode)
+  bencode.py   the bencode.py package (bencodepy.decode, bencodepy.encode)
+  bencodepy    the bencodepy package (bencodepy.decode, bencodepy.encode)
+
+The tool and its version are written to GENERATOR. With --fallback and none
+of them installed, the small BEP 3 decoder and encoder below are used
+instead and GENERATOR says so; that fallback was written for these tests and
+shares their authors' reading of BEP 3, so goldens made with it should be
+regenerated with an established implementation.
+
+Run it from this directory after adding or changing an input.
+"""
+
+import glob
+import hashlib
+import sys
+
+try:
+    from importlib import metadata
+except ImportError:  # Python < 3.8
+    metadata = None
+
+
+class Invalid(Exception):
+    pass
+
+
+def decode(data, i=0):
+    """Returns the value starting at data[i] and the offset after it.
+
+    This is the fallback decoder; raw_info also uses it to find the span of
+    the info dictionary, which the established implementations do not
+    report."""
+    if i >= len(data):
+        raise Invalid("unexpected end")
+    c = data[i:i + 1]
+    if c == b"i":
+        end = data.index(b"e", i)
+        text = data[i + 1:end]
+        digits = text[1:] if text.startswith(b"-") else text
+        if not digits.isdigit() or (digits.startswith(b"0") and len(digits) > 1) or text == b"-0":
+            raise Invalid("bad integer %r" % text)
+        return int(text), end + 1
+    if c == b"l":
+        i += 1
+        out = []
+        while data[i:i + 1] != b"e":
+            v, i = decode(data, i)
+            out.append(v)
+        return out, i + 1
+    if c == b"d":
+        i += 1
+        out = {}
+        while data[i:i + 1] != b"e":
+            if not data[i:i + 1].isdigit():
+                raise Invalid("key is not a string")
+            k, i = decode(data, i)
+            if k in out:
+                raise Invalid("duplicate key %r" % k)
+            out[k], i = decode(data, i)
+        return out, i + 1
+    if c.isdigit():
+        colon = data.index(b":", i)
+        text = data[i:colon]
+        if not text.isdigit() or (text.startswith(b"0") and len(text) > 1):
+            raise Invalid("bad length %r" % text)
+        end = colon + 1 + int(text)
+        if end > len(data):
+            raise Invalid("string past end")
+        return data[colon + 1:end], end
+    raise Invalid("unexpected %r" % c)
+
+
+def encode(v):
+    if isinstance(v, int):
+        return b"i%de" % v
+    if isinstance(v, bytes):
+        return b"%d:%s" % (len(v), v)
+    if isinstance(v, list):
+        return b"l" + b"".join(encode(e) for e in v) + b"e"
+    return b"d" + b"".join(encode(k) + encode(v[k]) for k in sorted(v)) + b"e"
+
+
+def raw_info(data):
+    """Returns the bytes of the top-level info value, or None."""
+    if data[:1] != b"d":
+        return None
+    i = 1
+    while data[i:i + 1] != b"e":
+        k, i = decode(data, i)
+        start = i
+        _, i = decode(data, i)
+        if k == b"info":
+            return data[start:i]
+    return None
+
+
+def distribution_version(*names):
+    for name in names:
+        try:
+            return metadata.version(name)
+        except Exception:
+            pass
+    return "unknown"
+
+
+def established():
+    """Returns the name, version, decode and encode of the first established
+    implementation that is installed, or None."""
+    try:
+        import libtorrent
+    except ImportError:
+        pass
+    else:
+        def lt_decode(data):
+            v = libtorrent.bdecode(data)
+            if v is None:
+                raise Invalid("rejected by libtorrent")
+            return v
+        return "libtorrent", libtorrent.__version__, lt_decode, libtorrent.bencode
+    try:
+        import bencodepy
+    except ImportError:
+        return None
+    if metadata is not None and distribution_version("bencode.py") != "unknown":
+        name, version = "bencode.py", distribution_version("bencode.py")
+    else:
+        name, version = "bencodepy", distribution_version("bencodepy")
+    return name, version, bencodepy.decode, bencodepy.encode
+
+
+def fallback_decode(data):
+    v, end = decode(data)
+    if end != len(data):
+        raise Invalid("trailing data")
+    return v
+
+
+def main():
+    impl = established()
+    if impl is None:
+        if "--fallback" not in sys.argv[1:]:
+            print("no established bencode implementation installed; "
+                  "install libtorrent or bencode.py, or pass --fallback",
+                  file=sys.stderr)
+            sys.exit(2)
+        impl = ("reference.py", "fallback", fallback_decode, encode)
+    tool, version, decode_all, encode_value = impl
+
+    status = 0
+    for name in sorted(glob.glob("*.invalid")):
+        data = open(name, "rb").read()
+        try:
+            decode_all(data)
+        except Exception:
+            continue
+        print("%s: %s accepts it" % (name, tool), file=sys.stderr)
+        status = 1
+
+    for name in sorted(glob.glob("*.torrent")):
+        base = name[:-len(".torrent")]
+        data = open(name, "rb").read()
+        open(base + ".canonical", "wb").write(encode_value(decode_all(data)))
+        info = raw_info(data)
+        if info is not None:
+            open(base + ".infohash", "w").write(hashlib.sha1(info).hexdigest() + "\n")
+
+    with open("GENERATOR", "w") as f:
+        if version == "fallback":
+            f.write("reference.py fallback (self-written, no established implementation)\n")
+        else:
+            f.write("%s %s\n" % (tool, version))
+    sys.exit(status)
+
+
+if __name__ == "__main__":
+    main()
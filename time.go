@@ -0,0 +1,26 @@
+package bencode
+
+import (
+	"reflect"
+	"strconv"
+	"time"
+)
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// timeEncoder encodes a time.Time as the integer number of seconds since the
+// Unix epoch.
+func timeEncoder(e *encodeState, v reflect.Value, _ encOpts) {
+	b := append(e.scratch[:0], 'i')
+	b = strconv.AppendInt(b, v.Interface().(time.Time).Unix(), 10)
+	e.Write(append(b, 'e'))
+}
+
+// rfc3339Encoder encodes a time.Time or *time.Time struct field with the
+// "rfc3339" tag option as a string in RFC 3339 format.
+func rfc3339Encoder(e *encodeState, v reflect.Value, _ encOpts) {
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	e.string(v.Interface().(time.Time).Format(time.RFC3339Nano))
+}
@@ -0,0 +1,226 @@
+package bencode
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"sort"
+	"strconv"
+)
+
+// Torrent is the metainfo stored in a .torrent file, as described by BEP 3.
+type Torrent struct {
+	Announce     string     `bencode:"announce,omitempty"`
+	AnnounceList [][]string `bencode:"announce-list,omitempty"`
+	Comment      string     `bencode:"comment,omitempty"`
+	CreatedBy    string     `bencode:"created by,omitempty"`
+	CreationDate int64      `bencode:"creation date,omitempty"`
+	Info         Info       `bencode:"info"`
+
+	// InfoHash is the SHA-1 hash of the info dictionary exactly as it
+	// appeared in the input to ParseTorrent.
+	InfoHash [20]byte `bencode:"-"`
+}
+
+// Info is the info dictionary of a torrent. A single-file torrent sets
+// Length and leaves Files nil; a multi-file torrent sets Files, in which case
+// Name is the name of the directory holding them.
+type Info struct {
+	Name        string `bencode:"name"`
+	PieceLength int64  `bencode:"piece length"`
+	Pieces      []byte `bencode:"pieces"`
+	Private     bool   `bencode:"private,omitempty"`
+	Length      int64  `bencode:"length,omitempty"`
+	Files       []File `bencode:"files,omitempty"`
+}
+
+// File is a single file of a multi-file torrent.
+type File struct {
+	Length int64    `bencode:"length"`
+	Path   []string `bencode:"path"`
+}
+
+// InfoV2 is the info dictionary of a BitTorrent v2 torrent, as described by
+// BEP 52. Hybrid torrents hold the fields of both Info and InfoV2.
+type InfoV2 struct {
+	Name        string   `bencode:"name"`
+	PieceLength int64    `bencode:"piece length"`
+	MetaVersion int      `bencode:"meta version"`
+	FileTree    FileTree `bencode:"file tree"`
+}
+
+// A FileTree is a node of the file tree of a BitTorrent v2 torrent: either a
+// directory, whose entries are keyed by the next path component, or a file.
+// In bencode, a file is a dictionary whose only key is the empty string,
+// holding the file's attributes, as in
+//
+//	d3:dird5:a.txtd0:d6:lengthi1eeeee
+//
+// for the file dir/a.txt of length 1.
+type FileTree struct {
+	// File holds the attributes of a file and is nil for a directory.
+	File *FileAttributes
+
+	// Dir holds the entries of a directory and is nil for a file.
+	Dir map[string]*FileTree
+}
+
+// FileAttributes are the attributes of a file in a FileTree.
+type FileAttributes struct {
+	Length int64 `bencode:"length"`
+
+	// PiecesRoot is the 32-byte root hash of the file's merkle tree of
+	// pieces. It is empty for an empty file.
+	PiecesRoot []byte `bencode:"pieces root,omitempty"`
+}
+
+// UnmarshalBencode implements Unmarshaler.
+func (t *FileTree) UnmarshalBencode(data []byte) error {
+	var entries map[string]RawMessage
+	if err := Unmarshal(data, &entries); err != nil {
+		return err
+	}
+	if attrs, ok := entries[""]; ok {
+		if len(entries) != 1 {
+			return errors.New("bencode: file tree node has both file attributes and entries")
+		}
+		f := new(FileAttributes)
+		if err := Unmarshal(attrs, f); err != nil {
+			return err
+		}
+		if len(f.PiecesRoot) != 0 && len(f.PiecesRoot) != sha256.Size {
+			return errors.New("bencode: pieces root length " + strconv.Itoa(len(f.PiecesRoot)) + " is not 32")
+		}
+		*t = FileTree{File: f}
+		return nil
+	}
+
+	dir := make(map[string]*FileTree, len(entries))
+	for name, entry := range entries {
+		child := new(FileTree)
+		if err := child.UnmarshalBencode(entry); err != nil {
+			return err
+		}
+		dir[name] = child
+	}
+	*t = FileTree{Dir: dir}
+	return nil
+}
+
+// MarshalBencode implements Marshaler.
+func (t FileTree) MarshalBencode() ([]byte, error) {
+	if t.File != nil {
+		return Marshal(map[string]*FileAttributes{"": t.File})
+	}
+	if t.Dir == nil {
+		return []byte("de"), nil
+	}
+	return Marshal(t.Dir)
+}
+
+// Walk calls fn for every file in t, in increasing byte order of their
+// paths, with the path of the file as a list of path components. Walk stops
+// and returns the error if fn returns one.
+func (t *FileTree) Walk(fn func(path []string, f *FileAttributes) error) error {
+	return t.walk(nil, fn)
+}
+
+func (t *FileTree) walk(path []string, fn func([]string, *FileAttributes) error) error {
+	if t.File != nil {
+		return fn(path, t.File)
+	}
+	names := make([]string, 0, len(t.Dir))
+	for name := range t.Dir {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		child := t.Dir[name]
+		if child == nil {
+			continue
+		}
+		if err := child.walk(append(path[:len(path):len(path)], name), fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MultiFile reports whether info describes a multi-file torrent.
+func (info *Info) MultiFile() bool {
+	return info.Files != nil
+}
+
+// PieceHashes returns the SHA-1 hash of every piece of the torrent.
+func (info *Info) PieceHashes() ([][20]byte, error) {
+	return PieceHashes(info.Pieces)
+}
+
+// PieceHashes splits the concatenated 20-byte SHA-1 hashes of a torrent's
+// pieces field into individual hashes. It makes a single allocation for all
+// of them and returns an error if len(pieces) is not a multiple of 20.
+func PieceHashes(pieces []byte) ([][20]byte, error) {
+	if len(pieces)%sha1.Size != 0 {
+		return nil, errors.New("bencode: pieces length " + strconv.Itoa(len(pieces)) + " is not a multiple of 20")
+	}
+	hashes := make([][20]byte, len(pieces)/sha1.Size)
+	for i := range hashes {
+		copy(hashes[i][:], pieces[i*sha1.Size:])
+	}
+	return hashes, nil
+}
+
+// Announces returns the tracker URLs of the torrent in data: its announce
+// URL followed by every URL of its announce-list, tier by tier, as described
+// by BEP 12. Either key may be missing. URLs appearing more than once are
+// only returned the first time, and empty ones not at all.
+func Announces(torrent []byte) ([]string, error) {
+	var t struct {
+		Announce     string     `bencode:"announce"`
+		AnnounceList [][]string `bencode:"announce-list"`
+	}
+	if err := Unmarshal(torrent, &t); err != nil {
+		return nil, err
+	}
+
+	var urls []string
+	seen := make(map[string]bool)
+	add := func(url string) {
+		if url != "" && !seen[url] {
+			seen[url] = true
+			urls = append(urls, url)
+		}
+	}
+	add(t.Announce)
+	for _, tier := range t.AnnounceList {
+		for _, url := range tier {
+			add(url)
+		}
+	}
+	return urls, nil
+}
+
+// ParseTorrent parses the metainfo in data and computes its info-hash.
+func ParseTorrent(data []byte) (*Torrent, error) {
+	t := new(Torrent)
+	v := struct {
+		*Torrent
+		Info RawMessage `bencode:"info"`
+	}{Torrent: t}
+
+	if err := Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	if v.Info == nil {
+		return nil, errors.New("bencode: torrent has no info dictionary")
+	}
+	if err := Unmarshal(v.Info, &t.Info); err != nil {
+		return nil, err
+	}
+	if t.Info.Files != nil && t.Info.Length != 0 {
+		return nil, errors.New("bencode: torrent info has both length and files")
+	}
+
+	t.InfoHash = sha1.Sum(v.Info)
+	return t, nil
+}